@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"rate-limiter/config"
+	"rate-limiter/ratelimiter"
+	"rate-limiter/revocation"
+	"strconv"
+	"time"
+)
+
+// Admin endpoints are served by the proxy itself rather than forwarded to the backend
+
+// adminOnly wraps a handler so it's only reachable with an admin JWT
+func (prox *RateLimitingProxy) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(wtr http.ResponseWriter, req *http.Request) {
+		claims, err := prox.validateAdminJWT(req)
+		if err != nil {
+			InfoLogger.Printf("Admin request rejected for %s %s: %v", req.Method, req.URL.Path, err)
+			writeProblem(wtr, req, authProblem(err))
+			return
+		}
+		InfoLogger.Printf("Admin request - AccountID: %d, %s, %s", claims.AccountID, req.Method, req.URL.Path)
+		next(wtr, req)
+	}
+}
+
+func writeJSON(wtr http.ResponseWriter, status int, body interface{}) {
+	wtr.Header().Set("Content-Type", "application/json")
+	wtr.WriteHeader(status)
+	if err := json.NewEncoder(wtr).Encode(body); err != nil {
+		ErrorLogger.Printf("Unable to write JSON response: %v", err)
+	}
+}
+
+type revocationRequest struct {
+	JTI       string    `json:"jti"`
+	Subject   string    `json:"sub"`
+	ExpiresAt time.Time `json:"expires_at"` // jti only - when the token would have expired
+	TTL       string    `json:"ttl"`        // Optional over-ride of the configured TTL
+}
+
+type revocationStatus struct {
+	JTI       string     `json:"jti,omitempty"`
+	Subject   string     `json:"sub,omitempty"`
+	Revoked   bool       `json:"revoked"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// handleRevocations manages the token deny-list
+//
+//	GET    /admin/revocations?jti=...|sub=...  - check
+//	POST   /admin/revocations                  - revoke, JSON body of jti/sub (+ expires_at or ttl)
+//	DELETE /admin/revocations?jti=...|sub=...  - lift
+func (prox *RateLimitingProxy) handleRevocations(wtr http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		prox.getRevocation(wtr, req)
+	case http.MethodPost:
+		prox.createRevocation(wtr, req)
+	case http.MethodDelete:
+		prox.deleteRevocation(wtr, req)
+	default:
+		wtr.Header().Set("Allow", "GET, POST, DELETE")
+		writeProblem(wtr, req, newProblem(http.StatusMethodNotAllowed, problemMethodNotAllowed, "Method not allowed", ""))
+	}
+}
+
+func (prox *RateLimitingProxy) getRevocation(wtr http.ResponseWriter, req *http.Request) {
+	jti, subject := req.URL.Query().Get("jti"), req.URL.Query().Get("sub")
+	if (jti == "") == (subject == "") {
+		writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemBadRequest, "Exactly one of jti or sub is required", ""))
+		return
+	}
+
+	var revokedAt time.Time
+	var err error
+	if jti != "" {
+		revokedAt, err = prox.revocations.TokenRevokedAt(req.Context(), jti)
+	} else {
+		revokedAt, err = prox.revocations.SubjectRevokedAt(req.Context(), subject)
+	}
+	if err != nil {
+		ErrorLogger.Printf("Revocation lookup failed: %v", err)
+		writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemStoreDown, "Revocation store unavailable", ""))
+		return
+	}
+
+	status := revocationStatus{JTI: jti, Subject: subject, Revoked: !revokedAt.IsZero()}
+	if status.Revoked {
+		status.RevokedAt = &revokedAt
+	}
+	writeJSON(wtr, http.StatusOK, status)
+}
+
+func (prox *RateLimitingProxy) createRevocation(wtr http.ResponseWriter, req *http.Request) {
+	var body revocationRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemBadRequest, "Invalid JSON body", ""))
+		return
+	}
+	if (body.JTI == "") == (body.Subject == "") {
+		writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemBadRequest, "Exactly one of jti or sub is required", ""))
+		return
+	}
+
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl <= 0 {
+			writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemBadRequest, "Invalid ttl", ""))
+			return
+		}
+	}
+
+	var err error
+	if body.JTI != "" {
+		expiresAt := body.ExpiresAt
+		if expiresAt.IsZero() {
+			if ttl == 0 {
+				ttl = prox.config.RevocationConfig.DefaultTokenTTL
+			}
+			expiresAt = time.Now().Add(ttl)
+		}
+		err = prox.revocations.RevokeToken(req.Context(), body.JTI, expiresAt)
+	} else {
+		if ttl == 0 {
+			ttl = prox.config.RevocationConfig.SubjectTTL
+		}
+		err = prox.revocations.RevokeSubject(req.Context(), body.Subject, ttl)
+	}
+	if errors.Is(err, revocation.ErrInvalid) {
+		writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemBadRequest, "Invalid revocation", err.Error()))
+		return
+	}
+	if err != nil {
+		ErrorLogger.Printf("Revocation failed: %v", err)
+		writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemStoreDown, "Revocation store unavailable", ""))
+		return
+	}
+
+	now := time.Now()
+	writeJSON(wtr, http.StatusCreated, revocationStatus{JTI: body.JTI, Subject: body.Subject, Revoked: true, RevokedAt: &now})
+}
+
+func (prox *RateLimitingProxy) deleteRevocation(wtr http.ResponseWriter, req *http.Request) {
+	jti, subject := req.URL.Query().Get("jti"), req.URL.Query().Get("sub")
+	if (jti == "") == (subject == "") {
+		writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemBadRequest, "Exactly one of jti or sub is required", ""))
+		return
+	}
+
+	var err error
+	if jti != "" {
+		err = prox.revocations.RestoreToken(req.Context(), jti)
+	} else {
+		err = prox.revocations.RestoreSubject(req.Context(), subject)
+	}
+	if err != nil {
+		ErrorLogger.Printf("Revocation removal failed: %v", err)
+		writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemStoreDown, "Revocation store unavailable", ""))
+		return
+	}
+	wtr.WriteHeader(http.StatusNoContent)
+}
+
+type quotaUsageResponse struct {
+	AccountID int64                    `json:"account_id"`
+	Period    string                   `json:"period,omitempty"`
+	Usage     []ratelimiter.QuotaUsage `json:"usage"`
+}
+
+// handleQuotaUsage reports calendar quota consumption for invoicing
+//
+//	GET /admin/quotas?account_id=12345[&period=2024-06]
+//
+// period is a prefix - a month matches the monthly counter and every daily counter in it
+func (prox *RateLimitingProxy) handleQuotaUsage(wtr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		wtr.Header().Set("Allow", "GET")
+		writeProblem(wtr, req, newProblem(http.StatusMethodNotAllowed, problemMethodNotAllowed, "Method not allowed", ""))
+		return
+	}
+
+	quotas, ok := prox.limiters[ratelimiter.CalendarQuota].(*ratelimiter.CalendarQuotaLimiter)
+	if !ok {
+		writeProblem(wtr, req, newProblem(http.StatusNotFound, problemNotFound, "No calendar quotas configured", ""))
+		return
+	}
+
+	accountId, err := strconv.ParseInt(req.URL.Query().Get("account_id"), 10, 64)
+	if err != nil || accountId <= 0 {
+		writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemBadRequest, "Valid account_id is required", ""))
+		return
+	}
+	period := req.URL.Query().Get("period")
+
+	usage, err := quotas.Usage(req.Context(), strconv.FormatInt(accountId, 10), period)
+	if err != nil {
+		ErrorLogger.Printf("Quota usage lookup failed: %v", err)
+		writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemStoreDown, "Quota store unavailable", ""))
+		return
+	}
+	if usage == nil {
+		usage = []ratelimiter.QuotaUsage{}
+	}
+	writeJSON(wtr, http.StatusOK, quotaUsageResponse{AccountID: accountId, Period: period, Usage: usage})
+}
+
+// handleAdaptive shows the adaptive limit multiplier, or resets it
+//
+//	GET    /admin/adaptive - current multiplier, and the backend stats it was based on
+//	DELETE /admin/adaptive - put limits straight back to 100%
+func (prox *RateLimitingProxy) handleAdaptive(wtr http.ResponseWriter, req *http.Request) {
+	if prox.adaptive == nil {
+		writeProblem(wtr, req, newProblem(http.StatusNotFound, problemNotFound, "Adaptive limits are not enabled", ""))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(wtr, http.StatusOK, prox.adaptive.Status())
+	case http.MethodDelete:
+		if err := prox.adaptive.Reset(req.Context()); err != nil {
+			ErrorLogger.Printf("Adaptive reset failed: %v", err)
+			writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemStoreDown, "Unable to reset adaptive multiplier", ""))
+			return
+		}
+		writeJSON(wtr, http.StatusOK, prox.adaptive.Status())
+	default:
+		wtr.Header().Set("Allow", "GET, DELETE")
+		writeProblem(wtr, req, newProblem(http.StatusMethodNotAllowed, problemMethodNotAllowed, "Method not allowed", ""))
+	}
+}
+
+type configResponse struct {
+	LoadedAt time.Time                `json:"loaded_at"`
+	Hash     string                   `json:"hash"`
+	Files    []string                 `json:"files"`
+	Sources  map[string]config.Source `json:"sources"` // Where each setting came from - default, file, env or flag
+	Config   map[string]interface{}   `json:"config"`  // Secrets redacted
+}
+
+// handleConfig shows the running config - as loaded, merged and over-ridden - and where each setting came from
+//
+//	GET /admin/config
+func (prox *RateLimitingProxy) handleConfig(wtr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		wtr.Header().Set("Allow", "GET")
+		writeProblem(wtr, req, newProblem(http.StatusMethodNotAllowed, problemMethodNotAllowed, "Method not allowed", ""))
+		return
+	}
+
+	cfg := prox.config
+	writeJSON(wtr, http.StatusOK, configResponse{
+		LoadedAt: cfg.LoadedAt,
+		Hash:     cfg.Hash(),
+		Files:    cfg.Files,
+		Sources:  cfg.Sources,
+		Config:   cfg.Redacted().Effective(),
+	})
+}
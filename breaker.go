@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"rate-limiter/config"
+	"rate-limiter/metrics"
+	"sync"
+	"time"
+)
+
+var (
+	circuitState  = metrics.NewGauge("ratelimiter_backend_circuit_state", "Each backend target's circuit breaker - 0 closed, 1 half-open, 2 open", "backend")
+	circuitOpened = metrics.NewCounter("ratelimiter_backend_circuit_opened_total", "Times each backend target's circuit breaker has opened", "backend")
+)
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"    // Requests go through, and their results are counted
+	circuitOpen     = "open"      // Nothing goes through until open_duration is up
+	circuitHalfOpen = "half_open" // A few trial requests go through - they decide whether it closes or opens again
+	circuitDisabled = "disabled"
+)
+
+// The rolling window is kept as this many buckets - the oldest drops off as a new one starts
+const breakerBuckets = 10
+
+// errCircuitOpen is what the transport gives up with when no target's breaker would let the request through
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// How a request let through by the breaker went
+type callResult int
+
+const (
+	callSucceeded callResult = iota
+	callFailed               // Transport error or 5xx
+	callAbandoned            // The client went away - that says nothing about the target
+)
+
+type breakerBucket struct {
+	start              time.Time
+	requests, failures int64
+}
+
+// circuitBreaker stops requests to a target that's failing - before they're dialed - so a backend that's fallen
+// over isn't buried under connections while it tries to get up. Health checks take a target out after a few
+// intervals; the breaker reacts to the live traffic within the window
+type circuitBreaker struct {
+	name     string
+	settings config.CircuitBreakerConfig
+
+	mu          sync.Mutex
+	state       string
+	openedAt    time.Time
+	buckets     [breakerBuckets]breakerBucket
+	consecutive int // Failures in a row
+	trials      int // Half-open trial requests in flight
+	trialPasses int
+}
+
+func newCircuitBreaker(name string, settings config.CircuitBreakerConfig) *circuitBreaker {
+	breaker := &circuitBreaker{name: name, settings: settings, state: circuitClosed}
+	if !settings.Enabled {
+		breaker.state = circuitDisabled
+	}
+	circuitState.Set(0, name)
+	return breaker
+}
+
+// Allow asks to send a request to the target. If it's let through, done must be called with how it went
+func (breaker *circuitBreaker) Allow() (done func(callResult), allowed bool) {
+	if !breaker.settings.Enabled {
+		return func(callResult) {}, true
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.advance()
+
+	switch breaker.state {
+	case circuitClosed:
+		return func(result callResult) { breaker.done(result, false) }, true
+	case circuitHalfOpen:
+		if breaker.trials < breaker.settings.HalfOpenRequests {
+			breaker.trials++
+			return func(result callResult) { breaker.done(result, true) }, true
+		}
+	}
+	return nil, false
+}
+
+func (breaker *circuitBreaker) done(result callResult, trial bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if trial {
+		breaker.trials--
+	}
+	if result == callAbandoned {
+		return
+	}
+
+	if trial {
+		if breaker.state != circuitHalfOpen {
+			return
+		}
+		if result == callFailed {
+			breaker.open("a trial request failed")
+			return
+		}
+		breaker.trialPasses++
+		if breaker.trialPasses >= breaker.settings.HalfOpenRequests {
+			breaker.close()
+		}
+		return
+	}
+	if breaker.state != circuitClosed {
+		return // Let through before it opened - it's already made up its mind
+	}
+
+	bucket := breaker.bucket(time.Now())
+	bucket.requests++
+	if result == callSucceeded {
+		breaker.consecutive = 0
+		return
+	}
+	bucket.failures++
+	breaker.consecutive++
+
+	if breaker.settings.ConsecutiveFailures > 0 && breaker.consecutive >= breaker.settings.ConsecutiveFailures {
+		breaker.open("failed requests in a row")
+		return
+	}
+	requests, failures := breaker.totals(time.Now())
+	if requests >= breaker.settings.MinRequests && float64(failures)/float64(requests) >= breaker.settings.ErrorRateThreshold {
+		breaker.open("error rate over the threshold")
+	}
+}
+
+// bucket returns the bucket for now, emptying it first if it last held an older stretch of time
+func (breaker *circuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := breaker.settings.Window / breakerBuckets
+	start := now.Truncate(width)
+	bucket := &breaker.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+func (breaker *circuitBreaker) totals(now time.Time) (requests, failures int64) {
+	for _, bucket := range breaker.buckets {
+		if now.Sub(bucket.start) < breaker.settings.Window {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// advance moves an open breaker to half-open once open_duration is up - it's checked when asked, not on a timer
+func (breaker *circuitBreaker) advance() {
+	if breaker.state == circuitOpen && time.Since(breaker.openedAt) >= breaker.settings.OpenDuration {
+		breaker.state = circuitHalfOpen
+		breaker.trials, breaker.trialPasses = 0, 0
+		circuitState.Set(1, breaker.name)
+		InfoLogger.Printf("Circuit breaker for %s half-open - trying it again", breaker.name)
+	}
+}
+
+func (breaker *circuitBreaker) open(reason string) {
+	requests, failures := breaker.totals(time.Now())
+	ErrorLogger.Printf("Circuit breaker for %s opened - %s (%d of %d failed in the window, %d in a row). Retrying in %s",
+		breaker.name, reason, failures, requests, breaker.consecutive, breaker.settings.OpenDuration)
+	breaker.state = circuitOpen
+	breaker.openedAt = time.Now()
+	circuitState.Set(2, breaker.name)
+	circuitOpened.Inc(breaker.name)
+}
+
+func (breaker *circuitBreaker) close() {
+	InfoLogger.Printf("Circuit breaker for %s closed", breaker.name)
+	breaker.state = circuitClosed
+	breaker.buckets = [breakerBuckets]breakerBucket{}
+	breaker.consecutive = 0
+	circuitState.Set(0, breaker.name)
+}
+
+// State returns the breaker's state as of now
+func (breaker *circuitBreaker) State() string {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.advance()
+	return breaker.state
+}
+
+// Available is false while the breaker won't let anything through - open, or half-open with every trial taken
+func (breaker *circuitBreaker) Available() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.advance()
+	return breaker.state != circuitOpen && !(breaker.state == circuitHalfOpen && breaker.trials >= breaker.settings.HalfOpenRequests)
+}
+
+// RetryAfter is how long until an open breaker tries the target again - 0 unless it's open
+func (breaker *circuitBreaker) RetryAfter() time.Duration {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if breaker.state != circuitOpen {
+		return 0
+	}
+	return max(0, breaker.settings.OpenDuration-time.Since(breaker.openedAt))
+}
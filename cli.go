@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"rate-limiter/config"
+	"rate-limiter/ratelimiter"
+	"rate-limiter/revocation"
+
+	"github.com/joho/godotenv"
+)
+
+const defaultEnvFile = "./docker/.env"
+
+// What we were asked to do on the command line
+type cliOptions struct {
+	command    string // serve (the default) or validate
+	configPath string // "" is the config package's default
+	envFile    string
+	envFileSet bool // Named on the command line - so it had better exist
+	port       int  // 0 keeps the configured port
+	logLevel   string
+	dev        bool // Allow the built-in JWT secret
+}
+
+// Log levels, most verbose first
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelError = "error"
+)
+
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n  %s [flags]            run the proxy\n  %s validate [flags]   check the config, print it (secrets redacted), and exit\n\nFlags:\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+}
+
+// parseFlags reads the command line. The validate subcommand can come before or after the flags
+func parseFlags(args []string) (*cliOptions, error) {
+	opts := &cliOptions{command: "serve"}
+	if len(args) > 0 && args[0] == "validate" {
+		opts.command = "validate"
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("rate-limiter", flag.ContinueOnError)
+	flags.Usage = usage(flags)
+	flags.StringVar(&opts.configPath, "config", "", "Config file (default application_config.json)")
+	flags.StringVar(&opts.envFile, "env-file", defaultEnvFile, "Env file to load before reading config - real env vars win")
+	flags.IntVar(&opts.port, "port", 0, "Listen port - over-rides server_config.port")
+	flags.StringVar(&opts.logLevel, "log-level", "", "Log level: debug, info or error (default info, error for validate)")
+	flags.BoolVar(&opts.dev, "dev", false, "Development mode - allow the built-in JWT secret")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() == 1 && flags.Arg(0) == "validate" && opts.command == "serve" {
+		opts.command = "validate"
+	} else if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	if opts.port < 0 || opts.port > 65535 {
+		return nil, fmt.Errorf("-port must be between 1 and 65535")
+	}
+	if opts.logLevel == "" {
+		opts.logLevel = logLevelInfo
+		if opts.command == "validate" {
+			opts.logLevel = logLevelError // Keep the output to the config itself
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		opts.envFileSet = opts.envFileSet || f.Name == "env-file"
+	})
+	return opts, nil
+}
+
+// setLogLevel points every package's loggers at the secret-masking writers, and quietens those below the level.
+// Errors are always logged
+func setLogLevel(level string) error {
+	infoLoggers := []*log.Logger{InfoLogger, config.InfoLogger, ratelimiter.InfoLogger, revocation.InfoLogger}
+	errorLoggers := []*log.Logger{ErrorLogger, config.ErrorLogger, ratelimiter.ErrorLogger, revocation.ErrorLogger}
+
+	infoOut, debugOut := io.Writer(logStdout), io.Writer(io.Discard)
+	switch level {
+	case logLevelDebug:
+		debugOut = logStdout
+	case logLevelInfo:
+	case logLevelError:
+		infoOut = io.Discard
+	default:
+		return fmt.Errorf("unknown log level %q - use %s, %s or %s", level, logLevelDebug, logLevelInfo, logLevelError)
+	}
+
+	for _, logger := range infoLoggers {
+		logger.SetOutput(infoOut)
+	}
+	for _, logger := range errorLoggers {
+		logger.SetOutput(logStderr)
+	}
+	config.DebugLogger.SetOutput(debugOut)
+	log.SetOutput(logStderr) // The standard logger - net/http's server errors go here
+	return nil
+}
+
+// loadEnvFile loads the .env file into the environment, without over-riding anything already set.
+// The default file is optional; one named on the command line isn't. -env-file="" skips it
+func loadEnvFile(opts *cliOptions) error {
+	if opts.envFile == "" {
+		return nil
+	}
+	if err := godotenv.Load(opts.envFile); err != nil {
+		if !opts.envFileSet && errors.Is(err, os.ErrNotExist) {
+			InfoLogger.Println("No .env file found, using system environment variables")
+			return nil
+		}
+		return fmt.Errorf("unable to load env file %s: %w", opts.envFile, err)
+	}
+	InfoLogger.Printf("Loaded environment from %s", opts.envFile)
+	return nil
+}
+
+// runValidate loads the config as the proxy would, prints the effective result, and returns the exit code
+func runValidate(opts *cliOptions) int {
+	// Same as serving: no config file at all is fine (env vars only), unless one was asked for
+	_, err := config.CheckFile(opts.configPath)
+	if err != nil && (opts.configPath != "" || !errors.Is(err, os.ErrNotExist)) {
+		fmt.Fprintf(os.Stderr, "Unable to read config file %s: %v\n", config.ResolvePath(opts.configPath), err)
+		return 1
+	}
+
+	cfg, err := loadConfig(opts)
+	if cfg != nil {
+		out, marshalErr := json.MarshalIndent(cfg.Redacted().Effective(), "", "  ")
+		if marshalErr != nil {
+			fmt.Fprintf(os.Stderr, "Unable to print config: %v\n", marshalErr)
+			return 1
+		}
+		fmt.Println(string(out))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config is invalid: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Config %s is valid\n", config.ResolvePath(opts.configPath))
+	return 0
+}
@@ -0,0 +1,187 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// The forwarding headers a trusted proxy can append the client to
+const (
+	HeaderXForwardedFor = "x-forwarded-for"
+	HeaderForwarded     = "forwarded" // RFC 7239
+)
+
+// IsKnownHeader reports whether header is a forwarding header the resolver can read
+func IsKnownHeader(header string) bool {
+	return header == HeaderXForwardedFor || header == HeaderForwarded
+}
+
+// Resolver works out who an anonymous caller is, for rate limiting.
+//
+// Forwarding headers are trivially spoofable, so they're only honoured when the connection comes from one of the
+// configured trusted proxies - and only the one header those proxies append to is read. A client can send both, so
+// falling back from one to the other would let it pick the chain that gets walked. Addresses are aggregated to a
+// prefix before use - a single IPv6 client typically owns a whole /64, and would otherwise get ~2^64 buckets
+type Resolver struct {
+	trustedProxies []netip.Prefix
+	header         string
+	ipv4PrefixLen  int
+	ipv6PrefixLen  int
+}
+
+func NewResolver(trustedCIDRs []string, header string, ipv4PrefixLen, ipv6PrefixLen int) (*Resolver, error) {
+	if !IsKnownHeader(header) {
+		return nil, fmt.Errorf("unknown forwarding header %q", header)
+	}
+	if ipv4PrefixLen <= 0 || ipv4PrefixLen > 32 {
+		return nil, fmt.Errorf("invalid IPv4 prefix length %d", ipv4PrefixLen)
+	}
+	if ipv6PrefixLen <= 0 || ipv6PrefixLen > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %d", ipv6PrefixLen)
+	}
+
+	var trusted []netip.Prefix
+	for _, cidr := range trustedCIDRs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %w", cidr, err)
+		}
+		trusted = append(trusted, prefix)
+	}
+
+	return &Resolver{
+		trustedProxies: trusted,
+		header:         header,
+		ipv4PrefixLen:  ipv4PrefixLen,
+		ipv6PrefixLen:  ipv6PrefixLen,
+	}, nil
+}
+
+// Accept bare addresses as single-host prefixes
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	if strings.Contains(cidr, "/") {
+		prefix, err := netip.ParsePrefix(cidr)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// IsTrusted reports whether addr is one of our trusted proxies
+func (r *Resolver) IsTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the originating client address for the request.
+//
+// We walk the forwarding chain from the nearest hop backwards, and stop at the first address we don't trust -
+// anything further left was supplied by the client and can't be believed
+func (r *Resolver) ClientAddr(req *http.Request) (netip.Addr, error) {
+	peer, err := remoteAddr(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !r.IsTrusted(peer) {
+		return peer, nil
+	}
+
+	hops := forwardedFor(req.Header, r.header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			// Garbage in the chain - the last trusted hop is the best we can do
+			return peer, nil
+		}
+		if !r.IsTrusted(hop) {
+			return hop, nil
+		}
+		peer = hop
+	}
+	return peer, nil // Everything in the chain is ours
+}
+
+// Identity returns the aggregated prefix used as the anonymous limiting key, eg "203.0.113.7/32", "2001:db8:1:2::/64"
+func (r *Resolver) Identity(req *http.Request) (string, error) {
+	addr, err := r.ClientAddr(req)
+	if err != nil {
+		return "", err
+	}
+	return r.Aggregate(addr).String(), nil
+}
+
+// Aggregate masks the address down to the configured prefix for its family
+func (r *Resolver) Aggregate(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := r.ipv6PrefixLen
+	if addr.Is4() {
+		bits = r.ipv4PrefixLen
+	}
+	prefix, _ := addr.Prefix(bits) // Only errors on out-of-range bits, which NewResolver rules out
+	return prefix
+}
+
+func remoteAddr(remote string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote // No port
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("unparsable remote address %q: %w", remote, err)
+	}
+	return addr.Unmap(), nil
+}
+
+// forwardedFor collects the client chain from the header the trusted proxies set, oldest first
+func forwardedFor(header http.Header, from string) []string {
+	var hops []string
+	if from == HeaderForwarded {
+		for _, line := range header.Values("Forwarded") {
+			for _, element := range strings.Split(line, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+					if found && strings.EqualFold(name, "for") {
+						hops = append(hops, value)
+					}
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, line := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(line, ",") {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHop handles the various shapes a hop comes in: 192.0.2.1, 192.0.2.1:4711, "[2001:db8::1]:4711", 2001:db8::1
+func parseHop(hop string) (netip.Addr, error) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+	if err != nil {
+		return netip.Addr{}, err // Includes RFC 7239 obfuscated identifiers and "unknown"
+	}
+	return addr.Unmap(), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"rate-limiter/config"
+	"rate-limiter/ratelimiter"
+	"rate-limiter/types"
+)
+
+// maxInFlightFor returns the concurrency cap for a request - the first matching endpoint that sets one, else the default.
+// 0 is unlimited
+func (prox *RateLimitingProxy) maxInFlightFor(req *http.Request) int64 {
+	if endpoint, ok := prox.matchEndpoint(req, func(e config.EndpointPolicy) bool { return e.MaxInFlight > 0 }); ok {
+		return endpoint.MaxInFlight
+	}
+	return prox.config.ConcurrencyConfig.MaxInFlight
+}
+
+// acquireLease takes an in-flight slot for the request. The caller must Release a non-nil lease once the response is done.
+// Returns false if the request has already been answered (too many in flight, or the check failed)
+func (prox *RateLimitingProxy) acquireLease(wtr http.ResponseWriter, req *http.Request, limitReq *types.RateLimitRequest) (*ratelimiter.Lease, bool) {
+	maxInFlight := prox.maxInFlightFor(req)
+	if maxInFlight <= 0 {
+		return nil, true
+	}
+	maxInFlight = prox.applyPriority(maxInFlight, limitReq.Priority) // Background jobs can't take every slot
+
+	path := limitReq.RequestPath
+	if prox.config.ConcurrencyConfig.Scope == config.ScopeAccount {
+		path = "*"
+	}
+
+	lease, err := prox.concurrency.Acquire(req.Context(), limitReq.Subject, path, maxInFlight)
+	if err != nil { // Fail closed, same as the rate limits
+		ErrorLogger.Printf("Concurrency check failed - AccountID: %d, Subject: %s, %v", limitReq.AccountID, limitReq.Subject, err)
+		writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemLimiterDown, "Rate Limiting Unavailable", "Unable to check concurrency limits"))
+		return nil, false
+	}
+	if lease == nil {
+		InfoLogger.Printf("Too many in-flight requests for account %d (%s) on path %s", limitReq.AccountID, limitReq.Subject, req.URL.Path)
+		wtr.Header().Set("Retry-After", "1") // No way to know when a slot frees up - have them try again shortly
+		writeProblem(wtr, req, newProblem(http.StatusTooManyRequests, problemTooManyInFlight, "Too many concurrent requests",
+			fmt.Sprintf("No more than %d requests can be in flight at once", maxInFlight)))
+		return nil, false
+	}
+	return lease, true
+}
@@ -1,13 +1,14 @@
 package config
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"rate-limiter/clientip"
 	"rate-limiter/ratelimiter"
-	"reflect"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -23,381 +24,615 @@ var (
 	DebugLogger = log.New(os.Stdout, "[CONFIG] DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
+// Built-in JWT secret, so the proxy runs out of the box for local testing - Validate refuses it unless AllowDefaultSecrets.
+// Redis has no built-in password: a Redis without one is a legitimate setup, and an empty env var can't clear a default
+const defaultJWTSecret = "your-secret-key"
+
+// AllowDefaultSecrets lets the built-in JWT secret through validation - development only (the -dev flag)
+var AllowDefaultSecrets = false
+
 // Container for the full config
 type Config struct {
-	JWTSecret         string                `json:"jwt_secret"`
-	DefaultlimitCount int64                 `json:"default_limit_count"` // Sensible, global default limit - unless over-ridden
-	DefaultPeriod     time.Duration         `json:"default_period"`      // And a default time period
+	JWTSecret         string                `json:"jwt_secret" secret:"true"` // Secrets can also be read from a file - see loadSecret
+	Enforce           bool                  `json:"enforce"`                  // false puts every limit in shadow mode, unless the limit says otherwise
+	RateLimitHeaders  string                `json:"rate_limit_headers"`       // Which headers describe the limits: legacy, standard or both
+	WatchInterval     time.Duration         `json:"config_watch_interval"`    // How often to check the config file for changes - 0 only reloads on SIGHUP
+	DefaultlimitCount int64                 `json:"default_limit_count"`      // Sensible, global default limit - unless over-ridden
+	DefaultPeriod     time.Duration         `json:"default_period"`           // And a default time period
 	MongoURL          string                `json:"mongo_url"`
 	RedisConfig       RedisConfig           `json:"redis_config"`
 	ServerConfig      HttpServerConfig      `json:"server_config"`
 	LimitingAlgorithm ratelimiter.Algorithm `json:"algorithm"`
 	AuthConfig        AuthConfig            `json:"auth_config"`
 	BackendConfig     BackendConfig         `json:"backend_config"`
+	RevocationConfig  RevocationConfig      `json:"revocation_config"`
+	AnonymousConfig   AnonymousConfig       `json:"anonymous_config"`
+	Limits            []LimitConfig         `json:"limits"`    // Every limit applies to every authenticated request - any one of them can deny it
+	Accounts          []AccountConfig       `json:"accounts"`  // Per-account settings
+	Endpoints         []EndpointPolicy      `json:"endpoints"` // Per-endpoint settings - first match wins
+	CostConfig        CostConfig            `json:"cost_config"`
+	ConcurrencyConfig ConcurrencyConfig     `json:"concurrency_config"`
+	AdaptiveConfig    AdaptiveConfig        `json:"adaptive_config"`
+	ThrottleConfig    ThrottleConfig        `json:"throttle_config"`
+	PriorityConfig    PriorityConfig        `json:"priority_config"`
+	HealthCheckConfig HealthCheckConfig     `json:"health_check_config"`
+	UpstreamConfig    UpstreamPolicy        `json:"upstream_config"` // Timeouts and retries talking to the backend - endpoints can over-ride it
+	RetryBudget       RetryBudgetConfig     `json:"retry_budget_config"`
+	CircuitBreaker    CircuitBreakerConfig  `json:"circuit_breaker_config"`
+	TLSConfig         ListenerTLSConfig     `json:"tls_config"` // HTTPS on the listener - off unless a cert and key are given
+
+	Sources  map[string]Source `json:"-"` // Where each setting came from, by dotted key path
+	Files    []string          `json:"-"` // The config file, everything it includes, and secret files - a change to any of them reloads
+	LoadedAt time.Time         `json:"-"`
 }
 
-type AuthConfig struct {
-	PublicPaths []string `json:"public_paths"`
-	AdminPaths  []string `json:"admin_paths"`
+// Shrink limits while the backend is struggling, grow them back while it's healthy (AIMD)
+type AdaptiveConfig struct {
+	Enabled                  bool          `json:"adaptive_enabled"`
+	Interval                 time.Duration `json:"adaptive_interval"`
+	ErrorRateThreshold       float64       `json:"error_rate_threshold"`
+	UnavailableRateThreshold float64       `json:"unavailable_rate_threshold"`
+	LatencyThreshold         time.Duration `json:"latency_threshold"`
+	IncreaseStep             float64       `json:"increase_step"`
+	DecreaseFactor           float64       `json:"decrease_factor"`
+	MinMultiplier            float64       `json:"min_multiplier"`
+	MinSamples               int64         `json:"min_samples"`
 }
 
-// HTTP Listening Server config
-type HttpServerConfig struct {
-	Port         int           `json:"port"`
-	ReadTimeout  time.Duration `json:"read_timeout"`
-	WriteTimeout time.Duration `json:"write_timeout"`
-	IdleTimeout  time.Duration `json:"idle_timeout"`
+// Caps on simultaneous in-flight requests, on top of the per-window limits
+type ConcurrencyConfig struct {
+	MaxInFlight int64         `json:"max_in_flight"` // Per account (or client IP), per scope. 0 is unlimited
+	LeaseTTL    time.Duration `json:"lease_ttl"`     // How long a crashed instance can hold on to its slots
+	Scope       string        `json:"scope"`         // path or account, same as limits
 }
 
-type RedisConfig struct {
-	URL      string `json:"redis_url"`
-	Username string `json:"redis_username"` // Must prefix, or it gets confused w/ system username
-	Password string `json:"redis_password"`
-	DB       int    `json:"db"`
-}
+// Per-endpoint settings. Path is exact, or a prefix ending in /* - same as auth paths
+type EndpointPolicy struct {
+	Path   string `json:"path"`
+	Method string `json:"method"` // Empty matches any method
+	Cost   int64  `json:"cost"`   // Units per request - 0 falls through to the method/default cost
+
+	MaxInFlight int64 `json:"max_in_flight"` // Over-rides concurrency_config.max_in_flight for this endpoint - 0 inherits
 
-type BackendConfig struct { // Future extension - this can be allowed to load multiple back-ends
-	URL            string `json:"backend_host"`
-	HealthcheckURL string `json:"backend_healthcheck_url"`
+	Mode     string        `json:"mode"`      // What happens over the limit: reject (429 straight away, the default) or throttle
+	MaxDelay time.Duration `json:"max_delay"` // Throttle only - longest we'll hold a request waiting for capacity
+
+	Upstream UpstreamPolicy `json:"upstream"` // Over-rides upstream_config for this endpoint - anything left out inherits
 }
 
-// Load reads configuration from a file
-func Load(filename string) (*Config, error) {
+// How requests are sent to the backend. In an endpoint's upstream section, zero values (and a missing retry_on) inherit
+type UpstreamPolicy struct {
+	DialTimeout           time.Duration `json:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `json:"response_header_timeout"` // From sending the request to the backend starting its answer
+	Timeout               time.Duration `json:"timeout"`                 // The whole exchange, retries included. 0 is no limit (beyond write_timeout)
+	Retry                 RetryPolicy   `json:"retry"`
+}
 
-	var configFilePath string = config_file_path // Allow injecting an over-ride of the default config path for later use
-	if strings.TrimSpace(filename) != "" {
-		configFilePath = filename
-	}
+type RetryPolicy struct {
+	MaxAttempts   int           `json:"max_attempts"`    // Including the first - 1 never retries
+	RetryOn       []string      `json:"retry_on"`        // Which failures are retried
+	BackoffBase   time.Duration `json:"backoff_base"`    // First retry waits up to this long, doubling each time after
+	BackoffMax    time.Duration `json:"backoff_max"`     // Cap on the wait
+	MaxReplayBody int64         `json:"max_replay_body"` // Bytes of request body held on to for a retry - bigger bodies are never retried
+}
 
-	var jsonData map[string]interface{}
-	var err error
+// Retry conditions
+const (
+	RetryConnectError = "connect_error" // Couldn't connect - the backend never saw the request
+	RetryReset        = "reset"         // The connection dropped before a response
+	Retry502          = "502"
+	Retry503          = "503"
+	Retry504          = "504"
+)
 
-	jsonData, err = loadJSONConfig(configFilePath)
-	if err != nil {
-		InfoLogger.Printf("Unable to load JSON config file at %s", config_file_path)
+// IsKnownRetryOn reports whether condition is a retry condition
+func IsKnownRetryOn(condition string) bool {
+	switch condition {
+	case RetryConnectError, RetryReset, Retry502, Retry503, Retry504:
+		return true
 	}
+	return false
+}
 
-	// Actually load things
-	config := &Config{
-		JWTSecret:         getStringVal("jwt_secret", "your-secret-key", jsonData),
-		DefaultlimitCount: getInt64("default_limit_count", 100, jsonData),
-		DefaultPeriod:     getDuration("default_period", time.Hour, jsonData),
-		MongoURL:          getStringVal("mongo_url", "mongodb://localhost:27017", jsonData),
-		LimitingAlgorithm: ratelimiter.Algorithm(getStringVal("algorithm", "allow_all", jsonData)),
-		RedisConfig: RedisConfig{
-			URL:      getNestedStringVal(jsonData, "redis_config", "redis_url", "localhost:6379"),
-			Username: getNestedStringVal(jsonData, "redis_config", "redis_username", ""),
-			Password: getNestedStringVal(jsonData, "redis_config", "redis_password", "test1234"),
-			DB:       getNestedIntVal(jsonData, "redis_config", "redis_db", 0),
-		},
-		ServerConfig: HttpServerConfig{
-			Port:         getNestedIntVal(jsonData, "server_config", "port", 8080),
-			ReadTimeout:  getNestedDurationVal(jsonData, "server_config", "read_timeout", 10*time.Second),
-			WriteTimeout: getNestedDurationVal(jsonData, "server_config", "write_timeout", 10*time.Second),
-			IdleTimeout:  getNestedDurationVal(jsonData, "server_config", "idle_timeout", 60*time.Second),
-		},
-		AuthConfig: AuthConfig{
-			PublicPaths: getStringSlice("public_paths", []string{"/health", "/metrics"}, jsonData),
-			AdminPaths:  getStringSlice("admin_paths", []string{"/admin/*", "/internal/*"}, jsonData),
-		},
-		BackendConfig: BackendConfig{
-			URL:            getNestedStringVal(jsonData, "backend_config", "backend_host", "http://localhost:9080"),
-			HealthcheckURL: getNestedStringVal(jsonData, "backend_config", "backend_healthcheck_url", "http://localhost:9080/health"),
-		},
-	}
+// A circuit breaker per backend target - it stops sending requests to a failing target for a while, then lets a
+// few through to see whether it's recovered. Failures are transport errors and 5xx responses
+type CircuitBreakerConfig struct {
+	Enabled             bool          `json:"circuit_breaker_enabled"`
+	Window              time.Duration `json:"breaker_window"`       // Rolling window the error rate is taken over
+	ErrorRateThreshold  float64       `json:"error_rate_threshold"` // Opens when this share of requests in the window fail...
+	MinRequests         int64         `json:"min_requests"`         // ...and the window has at least this many requests
+	ConsecutiveFailures int           `json:"consecutive_failures"` // Opens after this many failures in a row, whatever the rate. 0 is off
+	OpenDuration        time.Duration `json:"open_duration"`        // How long it stays open before trying the target again
+	HalfOpenRequests    int           `json:"half_open_requests"`   // Trial requests let through at once - all have to succeed to close it
+}
 
-	return config, config.Validate() // Return the config, and any errors when validating.
+// Retries are capped across all requests, so a struggling backend isn't buried under them
+type RetryBudgetConfig struct {
+	Ratio               float64 `json:"retry_budget_ratio"`     // Retries allowed, as a share of requests over the last 10s or so
+	MinRetriesPerSecond float64 `json:"min_retries_per_second"` // Always allowed, so quiet periods can still retry
 }
 
-// Validate checks if the configuration is valid
-func (c *Config) Validate() error {
-	var errBuilder strings.Builder
-	hasErrs := false
-	if strings.TrimSpace(c.JWTSecret) == "" {
-		errBuilder.WriteString("\t\tJWT secret cannot be empty\n")
-		hasErrs = true
+// UpstreamFor returns the upstream policy for an endpoint - its own settings over the top of upstream_config
+func (c *Config) UpstreamFor(endpoint EndpointPolicy) UpstreamPolicy {
+	policy, over := c.UpstreamConfig, endpoint.Upstream
+	if over.DialTimeout != 0 {
+		policy.DialTimeout = over.DialTimeout
 	}
-
-	if len(c.JWTSecret) < 32 {
-		errBuilder.WriteString("\t\tJWT is invalid\n")
-		hasErrs = true
+	if over.TLSHandshakeTimeout != 0 {
+		policy.TLSHandshakeTimeout = over.TLSHandshakeTimeout
 	}
-
-	if c.ServerConfig.Port < 0 || c.ServerConfig.Port > 65535 {
-		errBuilder.WriteString("\t\tServer port is invalid")
-		hasErrs = true
+	if over.ResponseHeaderTimeout != 0 {
+		policy.ResponseHeaderTimeout = over.ResponseHeaderTimeout
 	}
-
-	if strings.TrimSpace(c.MongoURL) == "" {
-		errBuilder.WriteString("\t\tMongoURL missing")
-		hasErrs = true
+	if over.Timeout != 0 {
+		policy.Timeout = over.Timeout
 	}
-
-	if strings.TrimSpace(c.RedisConfig.URL) == "" {
-		errBuilder.WriteString("\t\tRedis URL missing")
-		hasErrs = true
+	if over.Retry.MaxAttempts != 0 {
+		policy.Retry.MaxAttempts = over.Retry.MaxAttempts
 	}
-
-	if strings.TrimSpace(c.BackendConfig.URL) == "" {
-		errBuilder.WriteString("\t\tBackend URL missing")
-		hasErrs = true
+	if over.Retry.RetryOn != nil {
+		policy.Retry.RetryOn = over.Retry.RetryOn
 	}
-
-	if strings.TrimSpace(c.BackendConfig.HealthcheckURL) == "" {
-		errBuilder.WriteString("\t\tBackend Healthcheck URL missing")
-		hasErrs = true
+	if over.Retry.BackoffBase != 0 {
+		policy.Retry.BackoffBase = over.Retry.BackoffBase
+	}
+	if over.Retry.BackoffMax != 0 {
+		policy.Retry.BackoffMax = over.Retry.BackoffMax
 	}
-	// TODO
-	// Add some actual content validation for the URLs
-	// 	- Validate correct protocol for Mongo/Redis/HTTP
-	//	- Validate path/host are legal
-	// Actually validate the default timeouts
-
-	if hasErrs {
-		return fmt.Errorf("missing required configuration, or Invalid config supplied:\n%s", errBuilder.String())
+	if over.Retry.MaxReplayBody != 0 {
+		policy.Retry.MaxReplayBody = over.Retry.MaxReplayBody
 	}
-	return nil // Yay no errors
+	return policy
 }
 
-func getConfigVal(key string, defaultVal interface{}, jsonData map[string]interface{}) interface{} {
-	val := os.Getenv(key) // Env vars are primary
-	if val != "" {
-		return val
-	}
+// IsSet is true when an endpoint's upstream section sets anything at all
+func (p UpstreamPolicy) IsSet() bool {
+	return p.DialTimeout != 0 || p.TLSHandshakeTimeout != 0 || p.ResponseHeaderTimeout != 0 || p.Timeout != 0 ||
+		p.Retry.MaxAttempts != 0 || p.Retry.RetryOn != nil || p.Retry.BackoffBase != 0 || p.Retry.BackoffMax != 0 ||
+		p.Retry.MaxReplayBody != 0
+}
 
-	if jsonData != nil {
-		if val, exists := jsonData[key]; exists {
-			return val
+// RetriesOn reports whether the policy retries a failure
+func (p RetryPolicy) RetriesOn(condition string) bool {
+	for _, retryOn := range p.RetryOn {
+		if retryOn == condition {
+			return true
 		}
 	}
-	InfoLogger.Printf("Key %s not defined, load default %v", key, val)
-	return defaultVal
+	return false
 }
 
-func getStringVal(key string, defaultVal string, jsonData map[string]interface{}) string {
-	result := getConfigVal(key, defaultVal, jsonData)
-	if strVal, ok := result.(string); ok {
-		return strVal
-	}
-	InfoLogger.Printf("Config %s loaded default value %s", key, defaultVal)
-	return defaultVal
-}
+// Rate limit header styles
+const (
+	HeadersLegacy   = "legacy"   // X-RateLimit-Limit / -Remaining / -Reset
+	HeadersStandard = "standard" // RateLimit / RateLimit-Policy from the IETF httpapi draft
+	HeadersBoth     = "both"
+)
 
-func getInt(key string, defaultVal int, jsonData map[string]interface{}) int {
-	result := getConfigVal(key, defaultVal, jsonData)
+// Endpoint modes
+const (
+	ModeReject   = "reject"
+	ModeThrottle = "throttle"
+)
 
-	switch val := result.(type) {
-	case string:
-		if val == "" { // Empty string return default
-			InfoLogger.Printf("Config %s is empty - loaded default value %v", key, defaultVal)
-			return defaultVal
-		}
+// Priority classes
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
 
-		parsedVal, err := strconv.Atoi(val)
-		if err != nil {
-			ErrorLogger.Printf("invalid int value for %s: %s - Loaded default %v", key, val, defaultVal)
-			return defaultVal
-		}
-		return parsedVal
-	case float64:
-		return int(val) // JSON numbers are float64, right?
-	case int:
-		return val
+// Requests carry a priority class - from the JWT's priority claim, or a header set by trusted callers.
+// Lower classes only get a share of each limit, so the rest is held back for high priority traffic
+type PriorityConfig struct {
+	Header         string   `json:"priority_header"`  // Header trusted callers set the priority with - empty turns it off
+	TrustedCallers []string `json:"trusted_callers"`  // CIDRs allowed to set the header, eg our own frontend
+	Default        string   `json:"default_priority"` // When neither the token nor a trusted header says
+	LowShare       float64  `json:"low_share"`        // Fraction of each limit low priority traffic can use
+	NormalShare    float64  `json:"normal_share"`     // Fraction of each limit normal priority traffic can use - high always gets all of it
+}
+
+// ShareFor returns the fraction of a limit the priority class can use
+func (p PriorityConfig) ShareFor(priority string) float64 {
+	switch priority {
+	case PriorityLow:
+		return p.LowShare
+	case PriorityNormal:
+		return p.NormalShare
 	default:
-		InfoLogger.Printf("Unknown data type for key %s", key)
-		return defaultVal
+		return 1
 	}
 }
 
-func getInt64(key string, defaultVal int64, jsonData map[string]interface{}) int64 {
-	result := getConfigVal(key, defaultVal, jsonData)
+// IsKnownPriority reports whether priority is one of the classes
+func IsKnownPriority(priority string) bool {
+	return priority == PriorityLow || priority == PriorityNormal || priority == PriorityHigh
+}
 
-	switch val := result.(type) {
-	case string:
-		if val == "" {
-			InfoLogger.Printf("Config %s is empty - loaded default value %v", key, defaultVal)
-			return defaultVal
-		}
-		parsedVal, err := strconv.ParseInt(val, 10, 64)
-		if err != nil {
-			ErrorLogger.Printf("invalid int64 value for %s: %s - Loaded default %v", key, val, defaultVal)
-			return defaultVal
-		}
-		return parsedVal
-	case float64:
-		return int64(val)
-	case int64:
-		return val
-	default:
-		InfoLogger.Printf("Unknown data type for key %s", key)
-		return defaultVal
-	}
+// Active health checks of the backend. It's marked down after unhealthy_threshold failures in a row - checks, or
+// requests that get no response at all - and back up after healthy_threshold passing checks
+type HealthCheckConfig struct {
+	Interval           time.Duration `json:"health_check_interval"`
+	Timeout            time.Duration `json:"health_check_timeout"`
+	HealthyThreshold   int           `json:"healthy_threshold"`
+	UnhealthyThreshold int           `json:"unhealthy_threshold"`
 }
 
-func getDuration(key string, defaultValue time.Duration, jsonData map[string]interface{}) time.Duration {
-	result := getConfigVal(key, defaultValue, jsonData)
+// Throttled requests wait in a bounded, per-instance queue
+type ThrottleConfig struct {
+	QueueSize int `json:"throttle_queue_size"` // Max requests waiting at once - beyond this they're rejected as usual
+}
 
-	if str, ok := result.(string); ok {
-		if str == "" {
-			InfoLogger.Printf("Config %s is empty - loaded default value: %s", key, defaultValue)
-			return defaultValue
-		}
-		parsed, err := time.ParseDuration(str)
-		if err != nil {
-			ErrorLogger.Printf("invalid Duration for %s: %s - Loaded default %v", key, str, defaultValue)
-			return defaultValue
-		}
-		return parsed
-	}
-	InfoLogger.Printf("Config %s loaded default value %s", key, defaultValue)
-	return defaultValue
+// How many units a request uses up. Limits are measured in these units rather than requests
+type CostConfig struct {
+	DefaultCost int64            `json:"default_cost"`
+	MethodCosts map[string]int64 `json:"method_costs"` // eg {"POST": 5}
+	CostHeader  string           `json:"cost_header"`  // Backend response header reporting the real cost, debited after the fact. Empty disables
+}
+
+// Per-account settings, keyed by the JWT account_id
+type AccountConfig struct {
+	AccountID int64  `json:"account_id"`
+	Timezone  string `json:"timezone"` // IANA zone calendar quotas reset in - eg "America/New_York"
 }
 
-// Helper function to safely get nested string values
-func getNestedStringVal(jsonData map[string]interface{}, parentKey, childKey, defaultVal string) string {
-	// First check environment variables using the child key
-	if envVal := os.Getenv(childKey); envVal != "" {
-		return envVal
+// Limit scopes
+const (
+	ScopePath    = "path"    // Per account, per path
+	ScopeAccount = "account" // Per account, across all paths
+)
+
+// A single named limit - eg burst, sustained, daily
+type LimitConfig struct {
+	Name       string                `json:"name"`
+	LimitCount int64                 `json:"limit_count"`
+	Period     time.Duration         `json:"period"` // Not used by calendar quotas
+	Scope      string                `json:"scope"`
+	Algorithm  ratelimiter.Algorithm `json:"algorithm"` // Over-rides the global algorithm for this limit
+	Calendar   string                `json:"calendar"`  // Calendar quotas only - day or month
+	Timezone   string                `json:"timezone"`  // Calendar quotas only - fixed zone for this limit. Otherwise the account's, otherwise UTC
+	Enforce    bool                  `json:"enforce"`   // false is shadow mode - counted, logged, never denies. Defaults to the global enforce
+}
+
+// AlgorithmFor returns the algorithm enforcing a limit
+func (c *Config) AlgorithmFor(limit LimitConfig) ratelimiter.Algorithm {
+	if limit.Algorithm != "" {
+		return limit.Algorithm
 	}
+	return c.LimitingAlgorithm
+}
 
-	// Then check nested JSON
-	if parent, ok := jsonData[parentKey].(map[string]interface{}); ok {
-		if val, ok := parent[childKey].(string); ok {
-			return val
+// TimezoneFor returns the timezone a calendar quota resets in for an account
+func (c *Config) TimezoneFor(limit LimitConfig, accountId int64) string {
+	if limit.Timezone != "" {
+		return limit.Timezone
+	}
+	for _, account := range c.Accounts {
+		if account.AccountID == accountId && account.Timezone != "" {
+			return account.Timezone
 		}
 	}
+	return "UTC"
+}
 
-	return defaultVal
+type AuthConfig struct {
+	PublicPaths []string `json:"public_paths"`
+	AdminPaths  []string `json:"admin_paths"`
 }
 
-// Helper function to safely get nested int values (with env var support)
-func getNestedIntVal(jsonData map[string]interface{}, parentKey, childKey string, defaultVal int) int {
-	// First check environment variables
-	if envVal := os.Getenv(childKey); envVal != "" {
-		if parsedVal, err := strconv.Atoi(envVal); err == nil {
-			return parsedVal
-		}
+// HTTP Listening Server config
+type HttpServerConfig struct {
+	Port         int           `json:"port"`
+	ReadTimeout  time.Duration `json:"read_timeout"`
+	WriteTimeout time.Duration `json:"write_timeout"`
+	IdleTimeout  time.Duration `json:"idle_timeout"`
+	HTTP2        bool          `json:"http2"` // Offered over TLS
+	H2C          bool          `json:"h2c"`   // HTTP/2 without TLS, for in-cluster traffic - plain listener only
+}
+
+// TLS on the listener, so the proxy can be the edge. The cert, key and client CA files are read again when they
+// change - other settings need a restart
+type ListenerTLSConfig struct {
+	CertFile       string        `json:"cert_file"`
+	KeyFile        string        `json:"key_file"`
+	ClientCAFile   string        `json:"client_ca_file"`       // CA bundle client certs are checked against - mTLS
+	ClientAuth     string        `json:"client_auth"`          // none, optional (verified if given) or require
+	MinVersion     string        `json:"min_version"`          // 1.2 or 1.3
+	CipherSuites   []string      `json:"cipher_suites"`        // TLS 1.2 suites by name - empty for Go's defaults. 1.3's aren't configurable
+	ReloadInterval time.Duration `json:"cert_reload_interval"` // How often the files are checked for changes
+}
+
+// Enabled is true when there's a cert to serve
+func (t ListenerTLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Client cert checking
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional" // Verified if the client sends one
+	ClientAuthRequire  = "require"
+)
+
+// TLSVersion returns the crypto/tls version for a min_version setting
+func TLSVersion(version string) (uint16, bool) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, true
+	case "1.3":
+		return tls.VersionTLS13, true
 	}
+	return 0, false
+}
 
-	// Then check nested JSON
-	if parent, ok := jsonData[parentKey].(map[string]interface{}); ok {
-		if val, ok := parent[childKey].(float64); ok { // JSON numbers are float64
-			return int(val)
+// CipherSuite returns the ID of a cipher suite by its name, eg TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Suites Go
+// considers insecure are refused - insecure is true for those
+func CipherSuite(name string) (id uint16, insecure bool, known bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, false, true
 		}
 	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true, true
+		}
+	}
+	return 0, false, false
+}
+
+type RedisConfig struct {
+	URL      string `json:"redis_url"`
+	Username string `json:"redis_username"` // Must prefix, or it gets confused w/ system username
+	Password string `json:"redis_password" secret:"true"`
+	DB       int    `json:"db"`
+}
 
-	return defaultVal
+// Limits for unauthenticated traffic - keyed by client IP rather than account
+type AnonymousConfig struct {
+	LimitCount       int64         `json:"anonymous_limit_count"`
+	Period           time.Duration `json:"anonymous_period"`
+	TrustedProxies   []string      `json:"trusted_proxies"`    // CIDRs we accept the forwarded header from
+	ForwardedHeader  string        `json:"forwarded_header"`   // The one the trusted proxies append to - x-forwarded-for or forwarded
+	IPv4PrefixLength int           `json:"ipv4_prefix_length"` // Clients are aggregated to this prefix - /32 is per-address
+	IPv6PrefixLength int           `json:"ipv6_prefix_length"` // /64 is the usual single-subscriber allocation
+	Enforce          bool          `json:"anonymous_enforce"`  // false is shadow mode. Defaults to the global enforce
 }
 
-// Helper function to safely get nested duration values (with env var support)
-func getNestedDurationVal(jsonData map[string]interface{}, parentKey, childKey string, defaultVal time.Duration) time.Duration {
-	// First check environment variables
-	if envVal := os.Getenv(childKey); envVal != "" {
-		if parsed, err := time.ParseDuration(envVal); err == nil {
-			return parsed
-		}
-	}
+// Token deny-list settings
+type RevocationConfig struct {
+	CacheTTL        time.Duration `json:"revocation_cache_ttl"`   // How long an instance trusts its local copy of a lookup
+	CacheSize       int           `json:"revocation_cache_size"`  // Max locally cached lookups
+	SubjectTTL      time.Duration `json:"revocation_subject_ttl"` // Must cover the longest token lifetime we issue
+	DefaultTokenTTL time.Duration `json:"revocation_token_ttl"`   // Used when a jti is revoked without an expiry
+}
+
+// The backend - one URL, or a pool of replicas in backend_targets
+type BackendConfig struct {
+	URL            string          `json:"backend_url"`
+	HealthcheckURL string          `json:"backend_healthcheck_url"`
+	Targets        []BackendTarget `json:"backend_targets"` // Takes the place of backend_url when set
+	LoadBalancing  string          `json:"load_balancing"`  // How requests are spread over the targets
+	SlowStart      time.Duration   `json:"slow_start"`      // A target coming back up gets a growing share of traffic over this long. 0 is all at once
+}
 
-	// Then check nested JSON
-	if parent, ok := jsonData[parentKey].(map[string]interface{}); ok {
-		if val, ok := parent[childKey].(string); ok {
-			if parsed, err := time.ParseDuration(val); err == nil {
-				return parsed
-			}
+// One replica in the pool
+type BackendTarget struct {
+	URL            string `json:"target_url"`
+	HealthcheckURL string `json:"healthcheck_url"` // Defaults to target_url with backend_healthcheck_url's path
+}
+
+// Load balancing policies
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+	BalanceConsistentHash   = "consistent_hash" // On account ID (client IP for anonymous traffic) - each account sticks to one target
+)
+
+// IsKnownBalancing reports whether policy is a load balancing policy
+func IsKnownBalancing(policy string) bool {
+	return policy == BalanceRoundRobin || policy == BalanceLeastConnections || policy == BalanceConsistentHash
+}
+
+// Pool returns the targets to send traffic to - backend_targets, or backend_url on its own - each with its health check
+func (b BackendConfig) Pool() []BackendTarget {
+	if len(b.Targets) == 0 {
+		return []BackendTarget{{URL: b.URL, HealthcheckURL: b.HealthcheckURL}}
+	}
+	pool := make([]BackendTarget, len(b.Targets))
+	for i, target := range b.Targets {
+		if target.HealthcheckURL == "" {
+			target.HealthcheckURL = healthcheckFor(target.URL, b.HealthcheckURL)
 		}
+		pool[i] = target
 	}
-
-	return defaultVal
+	return pool
 }
 
-// Load the JSON config file, IF IT EXISTS
-func loadJSONConfig(filename string) (map[string]interface{}, error) {
-	data, err := os.ReadFile(filename)
+// healthcheckFor puts the shared health check's path on a target - replicas serve the same paths
+func healthcheckFor(targetURL, healthcheckURL string) string {
+	target, err := url.Parse(targetURL)
 	if err != nil {
-		return nil, err // File doesn't exist or can't read
+		return targetURL // Validation reports it
 	}
-
-	var jsonConfig map[string]interface{}
-	if err := json.Unmarshal(data, &jsonConfig); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	check, err := url.Parse(healthcheckURL)
+	if err != nil {
+		return targetURL
 	}
-
-	return jsonConfig, nil
+	target.Path, target.RawPath, target.RawQuery = check.Path, check.RawPath, check.RawQuery
+	return target.String()
 }
 
-// Relfective loading...
-// TODO/WIP
-type FieldInfo struct {
-	Name    string       // Go field name
-	Type    reflect.Type // Go type
-	JSONTag string       // JSON tag value
-	GoType  string       // Human-readable type name
+// ResolvePath returns the config file Load would read for filename - the default, if it's empty
+func ResolvePath(filename string) string {
+	if strings.TrimSpace(filename) != "" {
+		return filename
+	}
+	return config_file_path
 }
 
-func GetStructFields(structValue interface{}) ([]FieldInfo, error) {
-	var fields []FieldInfo
-	structType := reflect.TypeOf(structValue)
-	if structType.Kind() == reflect.Ptr { // Pointers we need the element type
-		structType = structType.Elem()
+// Defaults returns the config used for anything the file and env vars don't set
+func Defaults() *Config {
+	return &Config{
+		JWTSecret:         defaultJWTSecret,
+		Enforce:           true,
+		RateLimitHeaders:  HeadersLegacy,
+		WatchInterval:     5 * time.Second,
+		DefaultlimitCount: 100,
+		DefaultPeriod:     time.Hour,
+		MongoURL:          "mongodb://localhost:27017",
+		LimitingAlgorithm: ratelimiter.Permissive,
+		RedisConfig: RedisConfig{
+			URL: "localhost:6379",
+		},
+		ServerConfig: HttpServerConfig{
+			Port:         8080,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  60 * time.Second,
+			HTTP2:        true,
+		},
+		AuthConfig: AuthConfig{
+			PublicPaths: []string{"/health", "/metrics"},
+			AdminPaths:  []string{"/admin/*", "/internal/*"},
+		},
+		BackendConfig: BackendConfig{
+			URL:            "http://localhost:9080",
+			HealthcheckURL: "http://localhost:9080/health",
+			Targets:        []BackendTarget{},
+			LoadBalancing:  BalanceRoundRobin,
+		},
+		RevocationConfig: RevocationConfig{
+			CacheTTL:        5 * time.Second,
+			CacheSize:       10000,
+			SubjectTTL:      24 * time.Hour,
+			DefaultTokenTTL: 24 * time.Hour,
+		},
+		AnonymousConfig: AnonymousConfig{
+			LimitCount:       60,
+			Period:           time.Minute,
+			TrustedProxies:   []string{},
+			ForwardedHeader:  clientip.HeaderXForwardedFor,
+			IPv4PrefixLength: 32,
+			IPv6PrefixLength: 64,
+			Enforce:          true, // Follows the global enforce unless set
+		},
+		Limits:    []LimitConfig{}, // Without a limits table, the default limit count / period are the one and only limit
+		Accounts:  []AccountConfig{},
+		Endpoints: []EndpointPolicy{},
+		CostConfig: CostConfig{
+			DefaultCost: 1,
+			MethodCosts: map[string]int64{},
+			CostHeader:  "X-RateLimit-Cost",
+		},
+		ConcurrencyConfig: ConcurrencyConfig{
+			LeaseTTL: 30 * time.Second,
+			Scope:    ScopePath,
+		},
+		AdaptiveConfig: AdaptiveConfig{
+			Interval:                 10 * time.Second,
+			ErrorRateThreshold:       0.10,
+			UnavailableRateThreshold: 0.05,
+			LatencyThreshold:         2 * time.Second,
+			IncreaseStep:             0.05,
+			DecreaseFactor:           0.5,
+			MinMultiplier:            0.1,
+			MinSamples:               20,
+		},
+		ThrottleConfig: ThrottleConfig{
+			QueueSize: 100,
+		},
+		HealthCheckConfig: HealthCheckConfig{
+			Interval:           10 * time.Second,
+			Timeout:            2 * time.Second,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+		},
+		UpstreamConfig: UpstreamPolicy{
+			DialTimeout:         5 * time.Second,
+			TLSHandshakeTimeout: 5 * time.Second,
+			Retry: RetryPolicy{
+				MaxAttempts:   2,
+				RetryOn:       []string{RetryConnectError, RetryReset},
+				BackoffBase:   25 * time.Millisecond,
+				BackoffMax:    250 * time.Millisecond,
+				MaxReplayBody: 64 * 1024,
+			},
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			Enabled:             true,
+			Window:              10 * time.Second,
+			ErrorRateThreshold:  0.5,
+			MinRequests:         20,
+			ConsecutiveFailures: 5,
+			OpenDuration:        30 * time.Second,
+			HalfOpenRequests:    1,
+		},
+		TLSConfig: ListenerTLSConfig{
+			ClientAuth:     ClientAuthNone,
+			MinVersion:     "1.2",
+			CipherSuites:   []string{},
+			ReloadInterval: 30 * time.Second,
+		},
+		RetryBudget: RetryBudgetConfig{
+			Ratio:               0.2,
+			MinRetriesPerSecond: 5,
+		},
+		PriorityConfig: PriorityConfig{
+			Header:         "X-Priority",
+			TrustedCallers: []string{},
+			Default:        PriorityNormal,
+			LowShare:       1,
+			NormalShare:    1,
+		},
 	}
+}
 
-	// If it's not a struct, err out - this is *probably* fatal
-	if structType.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("invalid struct %s passed for reflective loading", structType.Kind())
+// Load reads configuration from a file, then env vars over the top, then validates it.
+//
+// Every key comes from its json tag - env vars are the RL_ prefixed, upper-cased path, with __ between levels,
+// eg redis_config.db is RL_REDIS_CONFIG__DB. Keys the config doesn't know, and values of the wrong type, are errors.
+// The config is returned even when there are errors, so it can be printed
+func Load(filename string) (*Config, error) {
+	configFilePath := ResolvePath(filename) // Allow injecting an over-ride of the default config path for later use
+
+	file, err := readConfigFile(configFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		InfoLogger.Printf("No config file at %s - using env vars and defaults", configFilePath)
+	} else if err != nil {
+		defaults := Defaults()
+		defaults.Files = file.files
+		return defaults, fmt.Errorf("unable to load config file %s: %w", configFilePath, err)
 	}
 
-	for i := 0; i < structType.NumField(); i++ {
-		field := structType.Field(i)
-		// Skip private fields (lowercase names)
-		if !field.IsExported() {
-			continue
-		}
-
-		jsonTag := field.Tag.Get("json")
-		// Remove options like ",omitempty" with array slicing
-		if comma := strings.Index(jsonTag, ","); comma != -1 {
-			jsonTag = jsonTag[:comma]
-		}
+	config := Defaults()
+	sources := newLoader(config).load(file.data)
+	config.Sources = sources.sources
+	config.Files = append(file.files, sources.files...)
+	config.LoadedAt = time.Now()
 
-		fieldInfo := FieldInfo{
-			Name:    field.Name,
-			Type:    field.Type,
-			JSONTag: jsonTag,
-			GoType:  field.Type.String(),
-		}
-		fields = append(fields, fieldInfo)
+	// Defaults that depend on other settings
+	if sources.sources["anonymous_config.anonymous_enforce"] == SourceDefault {
+		config.AnonymousConfig.Enforce = config.Enforce
 	}
-	return fields, nil
-}
-
-func getStringSlice(key string, defaultVal []string, jsonData map[string]interface{}) []string {
-	result := getConfigVal(key, defaultVal, jsonData)
-	switch val := result.(type) {
-	case []string:
-		return val // already string-slices
-	case string:
-		// split, return slices
-		if val == "" {
-			return defaultVal
-		}
-		if strings.Contains(val, ",") {
-			return strings.Split(val, ",")
+	if sources.sources["limits"] == SourceDefault {
+		config.Limits = []LimitConfig{
+			{Name: "default", LimitCount: config.DefaultlimitCount, Period: config.DefaultPeriod, Scope: ScopePath, Enforce: config.Enforce},
 		}
-		return []string{val} // worst case wrap and return
-	case []interface{}: // If it's not a string-type slice already
-		stringSlice := make([]string, len(val))
-		for i, v := range val {
-			if str, ok := v.(string); ok {
-				stringSlice[i] = str // Check that every item in there is a string
-			} else {
-				InfoLogger.Printf("Non-string value in %s array, using default", key)
-				return defaultVal
-			}
-			return stringSlice
-		}
-	default:
-		InfoLogger.Printf("Config %s loaded default value %v", key, defaultVal)
-		return defaultVal
 	}
-	return defaultVal
+	methodCosts := make(map[string]int64, len(config.CostConfig.MethodCosts))
+	for method, cost := range config.CostConfig.MethodCosts {
+		methodCosts[strings.ToUpper(method)] = cost // They're HTTP methods
+	}
+	config.CostConfig.MethodCosts = methodCosts
+
+	return config, errors.Join(sources.err(), config.Validate()) // Return the config, and any errors when loading or validating.
+}
+
+// CheckFile reports whether the config file and everything it includes exist and parse, and returns the files it read.
+// Load carries on with defaults and env vars when there's no file, which is fine at startup but not when reloading a half-saved file
+func CheckFile(filename string) ([]string, error) {
+	file, err := readConfigFile(ResolvePath(filename))
+	return file.files, err
 }
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	testJWTSecret     = "jwt-secret-that-is-long-enough-0123456789"
+	testRedisPassword = "redis-password-from-a-file"
+	testMongoPassword = "mongo-url-password"
+)
+
+// loadWithSecrets loads a config with the JWT secret from env, the Redis password from a file:// reference and a
+// password in the Mongo URL
+func loadWithSecrets(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "redis_password")
+	if err := os.WriteFile(secretFile, []byte(testRedisPassword+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.json")
+	contents := `{
+		"mongo_url": "mongodb://app:` + testMongoPassword + `@localhost:27017",
+		"redis_config": {"redis_password": "file://` + secretFile + `"}
+	}`
+	if err := os.WriteFile(configFile, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RL_JWT_SECRET", testJWTSecret)
+
+	cfg, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.JWTSecret != testJWTSecret || cfg.RedisConfig.Password != testRedisPassword {
+		t.Fatalf("secrets weren't loaded - jwt %q, redis %q", cfg.JWTSecret, cfg.RedisConfig.Password)
+	}
+	return cfg
+}
+
+func TestRedactedHidesSecrets(t *testing.T) {
+	cfg := loadWithSecrets(t)
+
+	effective, err := json.Marshal(cfg.Redacted().Effective())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumped := string(effective)
+	for _, secret := range []string{testJWTSecret, testRedisPassword, testMongoPassword} {
+		if strings.Contains(dumped, secret) {
+			t.Errorf("redacted config contains %q: %s", secret, dumped)
+		}
+	}
+	if !strings.Contains(dumped, `"jwt_secret":"[REDACTED]"`) {
+		t.Errorf("jwt_secret should show it's set, as [REDACTED]: %s", dumped)
+	}
+}
+
+func TestRedactedLeavesOriginalAlone(t *testing.T) {
+	cfg := loadWithSecrets(t)
+	cfg.BackendConfig.Targets = []BackendTarget{{URL: "http://user:" + testMongoPassword + "@backend:9080"}}
+
+	redacted := cfg.Redacted()
+	if redacted.BackendConfig.Targets[0].URL != "http://backend:9080" {
+		t.Errorf("target URL not redacted: %q", redacted.BackendConfig.Targets[0].URL)
+	}
+	if cfg.JWTSecret != testJWTSecret || cfg.RedisConfig.Password != testRedisPassword ||
+		!strings.Contains(cfg.BackendConfig.Targets[0].URL, testMongoPassword) {
+		t.Error("Redacted changed the config it was called on")
+	}
+}
+
+func TestSecretsListsEverySecret(t *testing.T) {
+	secrets := loadWithSecrets(t).Secrets()
+	for _, secret := range []string{testJWTSecret, testRedisPassword, testMongoPassword} {
+		if !slices.Contains(secrets, secret) {
+			t.Errorf("Secrets() is missing %q, so it wouldn't be masked in logs", secret)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Top level key listing other config files to merge in - a path, or a list of paths/globs, relative to the file
+const includeKey = "include"
+
+// configFile is the parsed config, with every include merged in
+type configFile struct {
+	data  map[string]interface{}
+	files []string // Every file read, the top one first - the reloader watches them all
+}
+
+// readConfigFile parses filename (JSON, YAML or TOML, by extension) and the files it includes.
+// Everything comes out as the types encoding/json would produce, so the loader only deals with one shape
+func readConfigFile(filename string) (*configFile, error) {
+	file := &configFile{}
+	data, err := file.read(filename, nil)
+	file.data = data
+	return file, err
+}
+
+func (file *configFile) read(filename string, including []string) (map[string]interface{}, error) {
+	file.files = append(file.files, filename)
+	for _, parent := range including {
+		if parent == filename {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(including, " -> "), filename)
+		}
+	}
+
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err // File doesn't exist or can't read
+	}
+	data, err := decodeConfig(filename, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := includePaths(filename, data[includeKey])
+	if err != nil {
+		return nil, err
+	}
+	delete(data, includeKey)
+
+	// Included files are the base; the including file's own settings go over the top
+	merged := map[string]interface{}{}
+	for _, path := range includes {
+		included, err := file.read(path, append(including, filename))
+		if err != nil {
+			// Not wrapped - a missing include is an error, where a missing top level file isn't
+			return nil, fmt.Errorf("%s includes %s: %v", filename, path, err)
+		}
+		merged = mergeConfig(merged, included)
+	}
+	return mergeConfig(merged, data), nil
+}
+
+// decodeConfig parses a config file by its extension
+func decodeConfig(filename string, raw []byte) (map[string]interface{}, error) {
+	var parsed interface{}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json":
+		if err := json.Unmarshal(raw, &parsed); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %w", err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(raw, &parsed); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+	case ".toml":
+		if _, err := toml.Decode(string(raw), &parsed); err != nil {
+			return nil, fmt.Errorf("failed to parse TOML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %q - use .json, .yaml, .yml or .toml", ext)
+	}
+	if parsed == nil {
+		return map[string]interface{}{}, nil // An empty YAML file is fine - it just sets nothing
+	}
+
+	// YAML and TOML have their own ideas about numbers and maps - a trip through JSON evens them out
+	asJSON, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value in config: %w", err)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(asJSON, &data); err != nil {
+		return nil, fmt.Errorf("config must be an object of settings: %w", err)
+	}
+	return data, nil
+}
+
+// includePaths resolves the include directive against the including file's directory. Globs match in name order
+func includePaths(filename string, includeVal interface{}) ([]string, error) {
+	var patterns []string
+	switch val := includeVal.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		patterns = []string{val}
+	case []interface{}:
+		for _, item := range val {
+			pattern, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: %s must be a path or a list of paths", filename, includeKey)
+			}
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s must be a path or a list of paths", filename, includeKey)
+	}
+
+	var paths []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			paths = append(paths, pattern) // A plain path has to exist
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad %s pattern %q: %w", filename, includeKey, pattern, err)
+		}
+		paths = append(paths, matches...) // A glob matching nothing is fine - eg an empty policies directory
+	}
+	return paths, nil
+}
+
+// mergeConfig lays over on top of base. Objects merge key by key, tables (arrays) are appended, and anything else
+// in over replaces base
+func mergeConfig(base, over map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(over))
+	for key, val := range base {
+		merged[key] = val
+	}
+	for key, overVal := range over {
+		switch val := overVal.(type) {
+		case map[string]interface{}:
+			if baseVal, isObject := merged[key].(map[string]interface{}); isObject {
+				merged[key] = mergeConfig(baseVal, val)
+				continue
+			}
+		case []interface{}:
+			if baseVal, isArray := merged[key].([]interface{}); isArray {
+				merged[key] = append(append([]interface{}{}, baseVal...), val...)
+				continue
+			}
+		}
+		merged[key] = overVal
+	}
+	return merged
+}
@@ -0,0 +1,372 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Env vars over-riding the config are this, plus the upper-cased key path - eg RL_REDIS_CONFIG__DB
+const EnvPrefix = "RL_"
+
+// Separates the levels of a key path in an env var name
+const envNesting = "__"
+
+// Secret settings can be read from a file instead: RL_JWT_SECRET_FILE=/run/secrets/jwt, or "file:///run/secrets/jwt"
+// as the value itself
+const (
+	secretFileSuffix = "_FILE"
+	secretFileScheme = "file://"
+)
+
+// Source is where a setting's value came from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag" // Command line over-rides, applied after Load
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// loader fills a Config from the parsed file and the environment, walking the struct by its json tags.
+// It keeps going after a bad value so every problem is reported at once
+type loader struct {
+	config    *Config
+	sources   map[string]Source
+	files     []string // Secret files read - watched for rotation along with the config file
+	errs      []string
+	templates map[reflect.Type]func() reflect.Value // Defaults for each item of a table, eg limits
+}
+
+func newLoader(config *Config) *loader {
+	return &loader{
+		config:  config,
+		sources: make(map[string]Source),
+		templates: map[reflect.Type]func() reflect.Value{
+			reflect.TypeOf(LimitConfig{}): func() reflect.Value {
+				// Read when the limits table is reached - the global enforce has been loaded by then
+				return reflect.ValueOf(LimitConfig{Scope: ScopePath, Enforce: config.Enforce})
+			},
+			reflect.TypeOf(EndpointPolicy{}): func() reflect.Value {
+				return reflect.ValueOf(EndpointPolicy{Mode: ModeReject})
+			},
+		},
+	}
+}
+
+func (l *loader) load(jsonData map[string]interface{}) *loader {
+	l.loadStruct(reflect.ValueOf(l.config).Elem(), jsonData, nil, true)
+	return l
+}
+
+func (l *loader) err() error {
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("unable to load config:\n\t\t%s\n", strings.Join(l.errs, "\n\t\t"))
+}
+
+func (l *loader) fail(path []string, format string, args ...interface{}) {
+	l.errs = append(l.errs, keyPath(path)+": "+fmt.Sprintf(format, args...))
+}
+
+// loadStruct sets each field from the env (if allowed), else the JSON, else leaves the default
+func (l *loader) loadStruct(target reflect.Value, data map[string]interface{}, path []string, fromEnv bool) {
+	known := make(map[string]bool)
+
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+		known[name] = true
+		fieldPath := append(append([]string{}, path...), name)
+		fieldVal := target.Field(i)
+		jsonVal, inFile := data[name]
+
+		// Nested sections - recurse, so each of their settings can come from a different place
+		if isSection(field.Type) {
+			section, isObject := jsonVal.(map[string]interface{})
+			if inFile && !isObject {
+				l.fail(fieldPath, "must be an object")
+			}
+			l.loadStruct(fieldVal, section, fieldPath, fromEnv)
+			continue
+		}
+
+		source := SourceDefault
+		if fromEnv {
+			source = l.loadEnv(field, fieldVal, fieldPath)
+		}
+		if source == SourceDefault && inFile {
+			l.setFromJSON(fieldVal, jsonVal, fieldPath)
+			source = SourceFile
+		}
+		if isSecret(field) {
+			l.loadSecretRef(fieldVal, fieldPath)
+		}
+		l.record(fieldPath, source)
+	}
+
+	for key := range data {
+		if !known[key] {
+			l.fail(append(append([]string{}, path...), key), "unknown key")
+		}
+	}
+}
+
+// loadEnv sets the field from its env var, if there is one - or for secrets, from the file its _FILE env var names
+func (l *loader) loadEnv(field reflect.StructField, target reflect.Value, path []string) Source {
+	envName := EnvName(path)
+	envVal, exists := os.LookupEnv(envName)
+	exists = exists && envVal != ""
+
+	if isSecret(field) {
+		if secretFile := os.Getenv(envName + secretFileSuffix); secretFile != "" {
+			if exists {
+				l.fail(path, "set by both %s and %s%s - pick one", envName, envName, secretFileSuffix)
+			}
+			l.readSecret(target, secretFile, path)
+			return SourceEnv
+		}
+	}
+
+	if exists {
+		if err := l.setFromEnv(target, envVal, path); err != nil {
+			l.fail(path, "invalid %s: %v", envName, err)
+		}
+		return SourceEnv
+	}
+	if legacy := os.Getenv(path[len(path)-1]); legacy != "" && len(path) < 3 {
+		ErrorLogger.Printf("Env var %s is no longer read - use %s", path[len(path)-1], envName)
+	}
+	return SourceDefault
+}
+
+// loadSecretRef swaps a file://path reference for the file's contents, wherever the reference came from
+func (l *loader) loadSecretRef(target reflect.Value, path []string) {
+	if ref := target.String(); strings.HasPrefix(ref, secretFileScheme) {
+		l.readSecret(target, strings.TrimPrefix(ref, secretFileScheme), path)
+	}
+}
+
+// readSecret sets the field to the contents of a secret file - eg a Docker or Kubernetes secret mount.
+// The file is watched, so rotating the secret reloads the config
+func (l *loader) readSecret(target reflect.Value, filename string, path []string) {
+	l.files = append(l.files, filename)
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		l.fail(path, "unable to read secret file: %v", err)
+		target.SetString("")
+		return
+	}
+	target.SetString(strings.TrimRight(string(contents), "\r\n")) // Editors and echo leave a trailing newline
+}
+
+// Table items (limits[0].name) aren't recorded individually - the table as a whole has one source
+func (l *loader) record(path []string, source Source) {
+	if !inTable(path) {
+		l.sources[keyPath(path)] = source
+		DebugLogger.Printf("Config %s from %s", keyPath(path), source)
+	}
+}
+
+// setFromEnv parses an env var into the field. Lists of strings are comma separated; anything else that isn't
+// a plain value (tables, maps) is given as JSON
+func (l *loader) setFromEnv(target reflect.Value, envVal string, path []string) error {
+	if target.Kind() == reflect.Slice && target.Type().Elem().Kind() == reflect.String {
+		items := []string{}
+		for _, item := range strings.Split(envVal, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		target.Set(reflect.ValueOf(items).Convert(target.Type()))
+		return nil
+	}
+
+	if target.Kind() == reflect.Slice || target.Kind() == reflect.Map || target.Kind() == reflect.Struct {
+		var jsonVal interface{}
+		if err := json.Unmarshal([]byte(envVal), &jsonVal); err != nil {
+			return fmt.Errorf("expected JSON: %w", err)
+		}
+		l.setFromJSON(target, jsonVal, path) // Reports its own errors, against the key that's wrong
+		return nil
+	}
+
+	return setScalar(target, envVal)
+}
+
+// setFromJSON decodes a parsed JSON value into the field, checking types as it goes
+func (l *loader) setFromJSON(target reflect.Value, jsonVal interface{}, path []string) {
+	if target.Type() == durationType {
+		str, ok := jsonVal.(string)
+		if !ok {
+			l.fail(path, "must be a duration string, eg \"30s\"")
+			return
+		}
+		if err := setScalar(target, str); err != nil {
+			l.fail(path, "%v", err)
+		}
+		return
+	}
+
+	switch target.Kind() {
+	case reflect.String:
+		str, ok := jsonVal.(string)
+		if !ok {
+			l.fail(path, "must be a string")
+			return
+		}
+		target.SetString(str)
+	case reflect.Bool:
+		flag, ok := jsonVal.(bool)
+		if !ok {
+			l.fail(path, "must be true or false")
+			return
+		}
+		target.SetBool(flag)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, ok := jsonVal.(float64) // JSON numbers are float64
+		if !ok || num != math.Trunc(num) {
+			l.fail(path, "must be a whole number")
+			return
+		}
+		target.SetInt(int64(num))
+	case reflect.Float32, reflect.Float64:
+		num, ok := jsonVal.(float64)
+		if !ok {
+			l.fail(path, "must be a number")
+			return
+		}
+		target.SetFloat(num)
+	case reflect.Slice:
+		items, ok := jsonVal.([]interface{})
+		if !ok {
+			l.fail(path, "must be an array")
+			return
+		}
+		slice := reflect.MakeSlice(target.Type(), len(items), len(items))
+		for i, item := range items {
+			itemPath := append(append([]string{}, path[:len(path)-1]...), fmt.Sprintf("%s[%d]", path[len(path)-1], i))
+			if template, exists := l.templates[target.Type().Elem()]; exists {
+				slice.Index(i).Set(template())
+			}
+			l.setFromJSON(slice.Index(i), item, itemPath)
+		}
+		target.Set(slice)
+	case reflect.Map:
+		entries, ok := jsonVal.(map[string]interface{})
+		if !ok {
+			l.fail(path, "must be an object")
+			return
+		}
+		mapVal := reflect.MakeMapWithSize(target.Type(), len(entries))
+		for key, entry := range entries {
+			entryVal := reflect.New(target.Type().Elem()).Elem()
+			l.setFromJSON(entryVal, entry, append(append([]string{}, path...), key))
+			mapVal.SetMapIndex(reflect.ValueOf(key), entryVal)
+		}
+		target.Set(mapVal)
+	case reflect.Struct:
+		fields, ok := jsonVal.(map[string]interface{})
+		if !ok {
+			l.fail(path, "must be an object")
+			return
+		}
+		l.loadStruct(target, fields, path, false) // Inside a table - no env vars for individual items
+	default:
+		l.fail(path, "unsupported config type %s", target.Type())
+	}
+}
+
+// setScalar parses a string into a plain value
+func setScalar(target reflect.Value, str string) error {
+	if target.Type() == durationType {
+		parsed, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(parsed))
+		return nil
+	}
+
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(str)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		target.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(str, 10, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetInt(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(str, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetFloat(parsed)
+	default:
+		return fmt.Errorf("unsupported config type %s", target.Type())
+	}
+	return nil
+}
+
+// EnvName returns the env var over-riding a key path, eg [redis_config db] -> RL_REDIS_CONFIG__DB
+func EnvName(path []string) string {
+	return EnvPrefix + strings.ToUpper(strings.Join(path, envNesting))
+}
+
+func keyPath(path []string) string {
+	return strings.Join(path, ".")
+}
+
+// Table items' paths carry an index, eg limits[0] - those settings are only ever part of their table
+func inTable(path []string) bool {
+	for _, part := range path {
+		if strings.Contains(part, "[") {
+			return true
+		}
+	}
+	return false
+}
+
+// isSection is true for nested config objects (redis_config etc) - not tables, and not durations
+func isSection(fieldType reflect.Type) bool {
+	return fieldType.Kind() == reflect.Struct && fieldType != durationType
+}
+
+// isSecret is true for fields tagged secret:"true" - they can come from files, and are redacted when printed
+func isSecret(field reflect.StructField) bool {
+	return field.Tag.Get("secret") == "true"
+}
+
+// jsonName is the field's key - "" for fields that aren't config (json:"-", unexported)
+func jsonName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,598 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"rate-limiter/clientip"
+	"rate-limiter/ratelimiter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minJWTSecretLength = 32              // HS256 wants at least as many bytes as the hash
+	minPeriod          = time.Second     // Window buckets are keyed by whole seconds
+	maxServerTimeout   = time.Hour       // Anything longer is a typo, and ties up connections
+	minLeaseTTL        = 3 * time.Second // Leases renew every TTL/3
+	minAdaptive        = time.Second     // The adaptive loop shouldn't spin
+	maxWatchInterval   = 24 * time.Hour  // Longer than this and nobody will think to wait for it
+	minWatchInterval   = 100 * time.Millisecond
+
+	minHealthCheckInterval = time.Second
+	maxRetryAttempts       = 10 // Beyond this a retry loop is just an outage amplifier
+	minBreakerWindow       = time.Second
+)
+
+// validator collects every problem with a config, against the key path that's wrong - eg limits[1].period
+type validator struct {
+	errs []string
+}
+
+func (v *validator) fail(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config:\n\t\t%s\n", strings.Join(v.errs, "\n\t\t"))
+}
+
+// Validate checks if the configuration is valid - all of it, reporting every problem at once
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if strings.TrimSpace(c.JWTSecret) == "" {
+		v.fail("jwt_secret", "cannot be empty")
+	} else if c.JWTSecret == defaultJWTSecret {
+		v.defaultSecret("jwt_secret")
+	} else if len(c.JWTSecret) < minJWTSecretLength {
+		v.fail("jwt_secret", "must be at least %d characters, got %d", minJWTSecretLength, len(c.JWTSecret))
+	}
+	if !ratelimiter.IsKnownAlgorithm(c.LimitingAlgorithm) {
+		v.fail("algorithm", "unknown algorithm %q - use one of %s", c.LimitingAlgorithm, knownAlgorithms())
+	}
+	v.positiveCount("default_limit_count", c.DefaultlimitCount)
+	v.period("default_period", c.DefaultPeriod)
+
+	v.validateServer(c.ServerConfig)
+	v.validateTLS(c.TLSConfig, c.ServerConfig)
+	v.url("mongo_url", c.MongoURL, "mongodb", "mongodb+srv")
+	v.hostPort("redis_config.redis_url", c.RedisConfig.URL)
+	if c.RedisConfig.DB < 0 {
+		v.fail("redis_config.db", "cannot be negative")
+	}
+	v.validateBackend(c.BackendConfig)
+
+	v.validateAuthPaths(c.AuthConfig)
+	v.validateRevocation(c.RevocationConfig)
+	v.validateAnonymous(c.AnonymousConfig)
+	v.validateLimits(c)
+	v.validateAccounts(c.Accounts)
+	v.validateCosts(c.CostConfig)
+	v.validateEndpoints(c)
+	v.validateConcurrency(c.ConcurrencyConfig)
+	if c.AdaptiveConfig.Enabled {
+		v.validateAdaptive(c.AdaptiveConfig)
+	}
+	v.validatePriority(c.PriorityConfig)
+	v.validateHealthCheck(c.HealthCheckConfig)
+	v.validateUpstream("upstream_config", c.UpstreamConfig, c.ServerConfig)
+	if c.CircuitBreaker.Enabled {
+		v.validateCircuitBreaker(c.CircuitBreaker)
+	}
+	if c.RetryBudget.Ratio < 0 {
+		v.fail("retry_budget_config.retry_budget_ratio", "cannot be negative")
+	}
+	if c.RetryBudget.MinRetriesPerSecond < 0 {
+		v.fail("retry_budget_config.min_retries_per_second", "cannot be negative")
+	}
+
+	if c.WatchInterval != 0 && (c.WatchInterval < minWatchInterval || c.WatchInterval > maxWatchInterval) {
+		v.fail("config_watch_interval", "must be 0 (off), or between %s and %s", minWatchInterval, maxWatchInterval)
+	}
+	switch c.RateLimitHeaders {
+	case HeadersLegacy, HeadersStandard, HeadersBoth:
+	default:
+		v.fail("rate_limit_headers", "%q must be one of %s, %s, %s", c.RateLimitHeaders, HeadersLegacy, HeadersStandard, HeadersBoth)
+	}
+	if c.ThrottleConfig.QueueSize < 0 {
+		v.fail("throttle_config.throttle_queue_size", "cannot be negative")
+	}
+
+	return v.err()
+}
+
+// defaultSecret refuses a built-in secret - everyone who has read the source knows it
+func (v *validator) defaultSecret(path string) {
+	if AllowDefaultSecrets {
+		ErrorLogger.Printf("%s is the built-in default - fine for development, never for production", path)
+		return
+	}
+	v.fail(path, "is the built-in default - set a real secret, or run with -dev for local testing")
+}
+
+func (v *validator) validateBackend(backend BackendConfig) {
+	if len(backend.Targets) == 0 {
+		v.url("backend_config.backend_url", backend.URL, "http", "https")
+	}
+	v.url("backend_config.backend_healthcheck_url", backend.HealthcheckURL, "http", "https")
+
+	seen := map[string]bool{}
+	for i, target := range backend.Targets {
+		path := fmt.Sprintf("backend_config.backend_targets[%d]", i)
+		v.url(path+".target_url", target.URL, "http", "https")
+		if target.HealthcheckURL != "" {
+			v.url(path+".healthcheck_url", target.HealthcheckURL, "http", "https")
+		}
+		if seen[target.URL] {
+			v.fail(path+".target_url", "%q is listed twice", target.URL)
+		}
+		seen[target.URL] = true
+	}
+
+	if !IsKnownBalancing(backend.LoadBalancing) {
+		v.fail("backend_config.load_balancing", "%q must be one of %s, %s, %s", backend.LoadBalancing,
+			BalanceRoundRobin, BalanceLeastConnections, BalanceConsistentHash)
+	}
+	if backend.SlowStart < 0 {
+		v.fail("backend_config.slow_start", "cannot be negative")
+	}
+}
+
+// validateUpstream checks a complete upstream policy - the global one, or an endpoint's merged over it
+func (v *validator) validateUpstream(path string, policy UpstreamPolicy, server HttpServerConfig) {
+	if policy.DialTimeout <= 0 {
+		v.fail(path+".dial_timeout", "must be positive")
+	}
+	if policy.TLSHandshakeTimeout <= 0 {
+		v.fail(path+".tls_handshake_timeout", "must be positive")
+	}
+	if policy.ResponseHeaderTimeout < 0 {
+		v.fail(path+".response_header_timeout", "cannot be negative")
+	}
+	if policy.Timeout < 0 {
+		v.fail(path+".timeout", "cannot be negative")
+	} else if policy.Timeout > 0 && server.WriteTimeout > 0 && policy.Timeout >= server.WriteTimeout {
+		v.fail(path+".timeout", "must be shorter than server_config.write_timeout (%s)", server.WriteTimeout)
+	}
+
+	retry := policy.Retry
+	if retry.MaxAttempts < 1 || retry.MaxAttempts > maxRetryAttempts {
+		v.fail(path+".retry.max_attempts", "must be between 1 (no retries) and %d", maxRetryAttempts)
+	}
+	for i, condition := range retry.RetryOn {
+		if !IsKnownRetryOn(condition) {
+			v.fail(fmt.Sprintf("%s.retry.retry_on[%d]", path, i), "%q must be one of %s, %s, %s, %s, %s", condition,
+				RetryConnectError, RetryReset, Retry502, Retry503, Retry504)
+		}
+	}
+	if retry.BackoffBase <= 0 {
+		v.fail(path+".retry.backoff_base", "must be positive")
+	}
+	if retry.BackoffMax < retry.BackoffBase {
+		v.fail(path+".retry.backoff_max", "cannot be less than backoff_base (%s)", retry.BackoffBase)
+	}
+	if retry.MaxReplayBody < 0 {
+		v.fail(path+".retry.max_replay_body", "cannot be negative")
+	}
+}
+
+func (v *validator) validateCircuitBreaker(breaker CircuitBreakerConfig) {
+	if breaker.Window < minBreakerWindow {
+		v.fail("circuit_breaker_config.breaker_window", "must be at least %s", minBreakerWindow)
+	}
+	v.fraction("circuit_breaker_config.error_rate_threshold", breaker.ErrorRateThreshold, true)
+	if breaker.MinRequests < 1 {
+		v.fail("circuit_breaker_config.min_requests", "must be at least 1")
+	}
+	if breaker.ConsecutiveFailures < 0 {
+		v.fail("circuit_breaker_config.consecutive_failures", "cannot be negative")
+	}
+	if breaker.OpenDuration <= 0 {
+		v.fail("circuit_breaker_config.open_duration", "must be positive")
+	}
+	if breaker.HalfOpenRequests < 1 {
+		v.fail("circuit_breaker_config.half_open_requests", "must be at least 1")
+	}
+}
+
+func (v *validator) validateHealthCheck(health HealthCheckConfig) {
+	if health.Interval < minHealthCheckInterval {
+		v.fail("health_check_config.health_check_interval", "must be at least %s", minHealthCheckInterval)
+	}
+	if health.Timeout <= 0 || health.Timeout >= health.Interval {
+		v.fail("health_check_config.health_check_timeout", "must be positive, and shorter than the interval")
+	}
+	if health.HealthyThreshold < 1 {
+		v.fail("health_check_config.healthy_threshold", "must be at least 1")
+	}
+	if health.UnhealthyThreshold < 1 {
+		v.fail("health_check_config.unhealthy_threshold", "must be at least 1")
+	}
+}
+
+func (v *validator) validateServer(server HttpServerConfig) {
+	if server.Port < 1 || server.Port > 65535 {
+		v.fail("server_config.port", "must be between 1 and 65535, got %d", server.Port)
+	}
+	v.timeout("server_config.read_timeout", server.ReadTimeout)
+	v.timeout("server_config.write_timeout", server.WriteTimeout)
+	v.timeout("server_config.idle_timeout", server.IdleTimeout)
+}
+
+func (v *validator) validateTLS(listener ListenerTLSConfig, server HttpServerConfig) {
+	if !listener.Enabled() {
+		if listener.ClientCAFile != "" || (listener.ClientAuth != "" && listener.ClientAuth != ClientAuthNone) {
+			v.fail("tls_config", "client certs need TLS - set cert_file and key_file")
+		}
+		return
+	}
+	if listener.CertFile == "" || listener.KeyFile == "" {
+		v.fail("tls_config", "cert_file and key_file go together")
+	}
+	if server.H2C {
+		v.fail("server_config.h2c", "is for a plain listener - over TLS, HTTP/2 is negotiated (server_config.http2)")
+	}
+	switch listener.ClientAuth {
+	case ClientAuthNone:
+		if listener.ClientCAFile != "" {
+			v.fail("tls_config.client_auth", "is %s, so client_ca_file would be ignored - use %s or %s", ClientAuthNone,
+				ClientAuthOptional, ClientAuthRequire)
+		}
+	case ClientAuthOptional, ClientAuthRequire:
+		if listener.ClientCAFile == "" {
+			v.fail("tls_config.client_ca_file", "is needed to verify client certs")
+		}
+	default:
+		v.fail("tls_config.client_auth", "%q must be one of %s, %s, %s", listener.ClientAuth, ClientAuthNone,
+			ClientAuthOptional, ClientAuthRequire)
+	}
+	version, ok := TLSVersion(listener.MinVersion)
+	if !ok {
+		v.fail("tls_config.min_version", "%q must be 1.2 or 1.3", listener.MinVersion)
+	}
+	for i, name := range listener.CipherSuites {
+		path := fmt.Sprintf("tls_config.cipher_suites[%d]", i)
+		switch _, insecure, known := CipherSuite(name); {
+		case !known:
+			v.fail(path, "unknown cipher suite %q", name)
+		case insecure:
+			v.fail(path, "%s is insecure", name)
+		}
+	}
+	if len(listener.CipherSuites) > 0 && version == tls.VersionTLS13 {
+		v.fail("tls_config.cipher_suites", "only apply to TLS 1.2 - with min_version 1.3 they'd be ignored")
+	}
+	if listener.ReloadInterval < minWatchInterval {
+		v.fail("tls_config.cert_reload_interval", "must be at least %s", minWatchInterval)
+	}
+}
+
+func (v *validator) validateRevocation(revocation RevocationConfig) {
+	if revocation.CacheTTL < 0 {
+		v.fail("revocation_config.revocation_cache_ttl", "cannot be negative")
+	}
+	if revocation.CacheSize <= 0 {
+		v.fail("revocation_config.revocation_cache_size", "must be positive")
+	}
+	v.period("revocation_config.revocation_subject_ttl", revocation.SubjectTTL)
+	v.period("revocation_config.revocation_token_ttl", revocation.DefaultTokenTTL)
+}
+
+func (v *validator) validateAnonymous(anonymous AnonymousConfig) {
+	v.positiveCount("anonymous_config.anonymous_limit_count", anonymous.LimitCount)
+	v.period("anonymous_config.anonymous_period", anonymous.Period)
+	if anonymous.IPv4PrefixLength < 1 || anonymous.IPv4PrefixLength > 32 {
+		v.fail("anonymous_config.ipv4_prefix_length", "must be between 1 and 32")
+	}
+	if anonymous.IPv6PrefixLength < 1 || anonymous.IPv6PrefixLength > 128 {
+		v.fail("anonymous_config.ipv6_prefix_length", "must be between 1 and 128")
+	}
+	v.cidrs("anonymous_config.trusted_proxies", anonymous.TrustedProxies)
+	if !clientip.IsKnownHeader(anonymous.ForwardedHeader) {
+		v.fail("anonymous_config.forwarded_header", "%q must be %s or %s", anonymous.ForwardedHeader,
+			clientip.HeaderXForwardedFor, clientip.HeaderForwarded)
+	}
+}
+
+func (v *validator) validateLimits(c *Config) {
+	if len(c.Limits) == 0 {
+		v.fail("limits", "at least one limit must be configured")
+	}
+
+	limitNames := make(map[string]bool)
+	for i, limit := range c.Limits {
+		path := fmt.Sprintf("limits[%d]", i)
+		if strings.TrimSpace(limit.Name) == "" {
+			v.fail(path+".name", "cannot be empty")
+		} else if limitNames[limit.Name] {
+			v.fail(path+".name", "%s is used by more than one limit", limit.Name)
+		} else if strings.Contains(limit.Name, ":") {
+			// The name is a segment of the Redis keys - quota usage reads it back as everything up to the first colon
+			v.fail(path+".name", "%q cannot contain a colon", limit.Name)
+		}
+		limitNames[limit.Name] = true
+
+		algorithm := c.AlgorithmFor(limit)
+		if limit.Algorithm != "" && !ratelimiter.IsKnownAlgorithm(algorithm) { // Otherwise it's the global algorithm, already checked
+			v.fail(path+".algorithm", "unknown algorithm %q - use one of %s", algorithm, knownAlgorithms())
+		}
+		v.positiveCount(path+".limit_count", limit.LimitCount)
+		if algorithm == ratelimiter.CalendarQuota {
+			if limit.Calendar != ratelimiter.CalendarDay && limit.Calendar != ratelimiter.CalendarMonth {
+				v.fail(path+".calendar", "%q must be %s or %s", limit.Calendar, ratelimiter.CalendarDay, ratelimiter.CalendarMonth)
+			}
+			v.timezone(path+".timezone", limit.Timezone)
+		} else {
+			v.period(path+".period", limit.Period)
+		}
+		if limit.Scope != ScopePath && limit.Scope != ScopeAccount {
+			v.fail(path+".scope", "%q must be %s or %s", limit.Scope, ScopePath, ScopeAccount)
+		}
+	}
+}
+
+func (v *validator) validateAccounts(accounts []AccountConfig) {
+	seen := make(map[int64]bool)
+	for i, account := range accounts {
+		path := fmt.Sprintf("accounts[%d]", i)
+		if account.AccountID <= 0 {
+			v.fail(path+".account_id", "must be positive, got %d", account.AccountID)
+		} else if seen[account.AccountID] {
+			v.fail(path+".account_id", "account %d is configured more than once", account.AccountID)
+		}
+		seen[account.AccountID] = true
+		v.timezone(path+".timezone", account.Timezone)
+	}
+}
+
+func (v *validator) validateCosts(costs CostConfig) {
+	if costs.DefaultCost <= 0 {
+		v.fail("cost_config.default_cost", "must be positive")
+	}
+	for method, cost := range costs.MethodCosts {
+		if cost <= 0 {
+			v.fail("cost_config.method_costs."+method, "must be positive")
+		}
+	}
+}
+
+func (v *validator) validateEndpoints(c *Config) {
+	server := c.ServerConfig
+	for i, endpoint := range c.Endpoints {
+		path := fmt.Sprintf("endpoints[%d]", i)
+		v.pathPattern(path+".path", endpoint.Path)
+		if endpoint.Cost < 0 {
+			v.fail(path+".cost", "cannot be negative")
+		}
+		if endpoint.MaxInFlight < 0 {
+			v.fail(path+".max_in_flight", "cannot be negative")
+		}
+		switch endpoint.Mode {
+		case ModeReject:
+		case ModeThrottle:
+			if endpoint.MaxDelay <= 0 {
+				v.fail(path+".max_delay", "throttled endpoints need a positive max_delay")
+			} else if endpoint.MaxDelay >= server.WriteTimeout {
+				v.fail(path+".max_delay", "must be shorter than server_config.write_timeout (%s)", server.WriteTimeout)
+			}
+		default:
+			v.fail(path+".mode", "%q must be %s or %s", endpoint.Mode, ModeReject, ModeThrottle)
+		}
+		if endpoint.Upstream.IsSet() {
+			v.validateUpstream(path+".upstream", c.UpstreamFor(endpoint), server)
+		}
+	}
+}
+
+func (v *validator) validateConcurrency(concurrency ConcurrencyConfig) {
+	if concurrency.MaxInFlight < 0 {
+		v.fail("concurrency_config.max_in_flight", "cannot be negative")
+	}
+	if concurrency.LeaseTTL < minLeaseTTL {
+		v.fail("concurrency_config.lease_ttl", "must be at least %s", minLeaseTTL)
+	}
+	if concurrency.Scope != ScopePath && concurrency.Scope != ScopeAccount {
+		v.fail("concurrency_config.scope", "%q must be %s or %s", concurrency.Scope, ScopePath, ScopeAccount)
+	}
+}
+
+func (v *validator) validateAdaptive(adaptive AdaptiveConfig) {
+	if adaptive.Interval < minAdaptive {
+		v.fail("adaptive_config.adaptive_interval", "must be at least %s", minAdaptive)
+	}
+	v.fraction("adaptive_config.decrease_factor", adaptive.DecreaseFactor, false)
+	v.fraction("adaptive_config.increase_step", adaptive.IncreaseStep, true)
+	v.fraction("adaptive_config.min_multiplier", adaptive.MinMultiplier, true)
+	if adaptive.ErrorRateThreshold <= 0 {
+		v.fail("adaptive_config.error_rate_threshold", "must be positive")
+	}
+	if adaptive.UnavailableRateThreshold <= 0 {
+		v.fail("adaptive_config.unavailable_rate_threshold", "must be positive")
+	}
+	if adaptive.LatencyThreshold <= 0 {
+		v.fail("adaptive_config.latency_threshold", "must be positive")
+	}
+	if adaptive.MinSamples < 0 {
+		v.fail("adaptive_config.min_samples", "cannot be negative")
+	}
+}
+
+func (v *validator) validatePriority(priority PriorityConfig) {
+	if !IsKnownPriority(priority.Default) {
+		v.fail("priority_config.default_priority", "%q must be one of %s, %s, %s", priority.Default, PriorityLow, PriorityNormal, PriorityHigh)
+	}
+	if priority.LowShare <= 0 || priority.LowShare > priority.NormalShare || priority.NormalShare > 1 {
+		v.fail("priority_config", "shares must satisfy 0 < low_share <= normal_share <= 1")
+	}
+	v.cidrs("priority_config.trusted_callers", priority.TrustedCallers)
+}
+
+// validateAuthPaths catches patterns that can never take effect. Admin paths win over public ones, so a public
+// path inside an admin path is dead config - and usually means someone thinks an endpoint is open when it isn't
+func (v *validator) validateAuthPaths(auth AuthConfig) {
+	for i, pattern := range auth.AdminPaths {
+		v.pathPattern(fmt.Sprintf("auth_config.admin_paths[%d]", i), pattern)
+	}
+	for i, pattern := range auth.PublicPaths {
+		v.pathPattern(fmt.Sprintf("auth_config.public_paths[%d]", i), pattern)
+	}
+	v.shadowedPaths("auth_config.admin_paths", auth.AdminPaths, nil)
+	v.shadowedPaths("auth_config.public_paths", auth.PublicPaths, auth.AdminPaths)
+}
+
+// shadowedPaths flags patterns covered by an earlier one in the same list, or by any of the winning patterns
+func (v *validator) shadowedPaths(listPath string, patterns, winners []string) {
+	for i, pattern := range patterns {
+		path := fmt.Sprintf("%s[%d]", listPath, i)
+		for _, winner := range winners {
+			if pathCovers(winner, pattern) {
+				v.fail(path, "%q is shadowed by admin path %q - admin paths always win", pattern, winner)
+			}
+		}
+		for _, earlier := range patterns[:i] {
+			if pathCovers(earlier, pattern) {
+				v.fail(path, "%q is already covered by %q", pattern, earlier)
+			}
+		}
+	}
+}
+
+// PathMatches reports whether a request path matches a configured path: exact, or a prefix ending in /*
+// (eg "/admin/*" matches "/admin" and "/admin/users" - but not "/administrator", the prefix ends at a /)
+func PathMatches(requestPath, pattern string) bool {
+	if requestPath == pattern {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		prefix := strings.TrimSuffix(pattern, "/*")
+		return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+	}
+	return false
+}
+
+// pathCovers reports whether every request pattern b matches is also matched by a
+func pathCovers(a, b string) bool {
+	if !strings.HasSuffix(b, "/*") {
+		return PathMatches(b, a)
+	}
+	return strings.HasSuffix(a, "/*") && PathMatches(strings.TrimSuffix(b, "/*"), a)
+}
+
+func (v *validator) pathPattern(path, pattern string) {
+	if !strings.HasPrefix(pattern, "/") {
+		v.fail(path, "%q must start with /", pattern)
+	}
+	if strings.Contains(strings.TrimSuffix(pattern, "/*"), "*") {
+		v.fail(path, "%q - wildcards only work as a trailing /*", pattern)
+	}
+}
+
+func (v *validator) url(path, raw string, schemes ...string) {
+	if strings.TrimSpace(raw) == "" {
+		v.fail(path, "cannot be empty")
+		return
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		v.fail(path, "not a valid URL: %v", err)
+		return
+	}
+	schemeOK := false
+	for _, scheme := range schemes {
+		schemeOK = schemeOK || parsed.Scheme == scheme
+	}
+	if !schemeOK {
+		v.fail(path, "scheme must be one of %s, got %q", strings.Join(schemes, ", "), parsed.Scheme)
+	}
+	if parsed.Hostname() == "" {
+		v.fail(path, "has no host")
+	}
+	if port := parsed.Port(); port != "" {
+		v.port(path, port)
+	}
+}
+
+// hostPort checks a plain host:port address - what the Redis client dials
+func (v *validator) hostPort(path, addr string) {
+	if strings.TrimSpace(addr) == "" {
+		v.fail(path, "cannot be empty")
+		return
+	}
+	if strings.Contains(addr, "://") {
+		v.fail(path, "must be host:port, not a URL - got %q", addr)
+		return
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.fail(path, "must be host:port: %v", err)
+		return
+	}
+	if host == "" {
+		v.fail(path, "has no host")
+	}
+	v.port(path, port)
+}
+
+func (v *validator) port(path, port string) {
+	if num, err := strconv.Atoi(port); err != nil || num < 1 || num > 65535 {
+		v.fail(path, "port %q must be between 1 and 65535", port)
+	}
+}
+
+func (v *validator) timeout(path string, timeout time.Duration) {
+	if timeout <= 0 || timeout > maxServerTimeout {
+		v.fail(path, "must be positive and at most %s, got %s", maxServerTimeout, timeout)
+	}
+}
+
+func (v *validator) period(path string, period time.Duration) {
+	if period < minPeriod {
+		v.fail(path, "must be at least %s, got %s", minPeriod, period)
+	}
+}
+
+func (v *validator) positiveCount(path string, count int64) {
+	if count <= 0 {
+		v.fail(path, "must be positive, got %d", count)
+	}
+}
+
+// fraction checks 0 < val < 1, or val <= 1 if one is allowed
+func (v *validator) fraction(path string, val float64, oneAllowed bool) {
+	if val <= 0 || val > 1 || (val == 1 && !oneAllowed) {
+		if oneAllowed {
+			v.fail(path, "must be above 0 and at most 1")
+		} else {
+			v.fail(path, "must be between 0 and 1")
+		}
+	}
+}
+
+func (v *validator) timezone(path, zone string) {
+	if _, err := time.LoadLocation(zone); err != nil {
+		v.fail(path, "unknown timezone %q", zone)
+	}
+}
+
+// cidrs checks addresses/CIDRs the same way the client IP resolver will parse them
+func (v *validator) cidrs(path string, cidrs []string) {
+	for i, cidr := range cidrs {
+		if _, err := clientip.NewResolver([]string{cidr}, clientip.HeaderXForwardedFor, 32, 128); err != nil {
+			v.fail(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+func knownAlgorithms() string {
+	names := []string{}
+	for _, alg := range ratelimiter.Algorithms() {
+		names = append(names, string(alg))
+	}
+	return strings.Join(names, ", ")
+}
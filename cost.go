@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"rate-limiter/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestCost works out how many units a request uses up, most specific first:
+// the first matching endpoint policy with a cost, then the method's cost, then the default
+func (prox *RateLimitingProxy) requestCost(req *http.Request) int64 {
+	if endpoint, ok := prox.matchEndpoint(req, func(e config.EndpointPolicy) bool { return e.Cost > 0 }); ok {
+		return endpoint.Cost
+	}
+
+	if cost, exists := prox.config.CostConfig.MethodCosts[req.Method]; exists {
+		return cost
+	}
+	return prox.config.CostConfig.DefaultCost
+}
+
+// debitReportedCost charges the difference when the backend says a request cost more than we thought.
+// Some costs can only be known after the fact - eg how many rows an export actually returned.
+// We only ever debit: the request has already been let through, and refunding units is an easy abuse vector
+func (prox *RateLimitingProxy) debitReportedCost(resp *http.Response) error {
+	header := prox.config.CostConfig.CostHeader
+	if header == "" {
+		return nil
+	}
+	reported := strings.TrimSpace(resp.Header.Get(header))
+	if reported == "" {
+		return nil
+	}
+	resp.Header.Del(header) // Between us and the backend - not for the client
+
+	state, ok := proxiedRequestFrom(resp.Request.Context())
+	if !ok {
+		return nil
+	}
+
+	actualCost, err := strconv.ParseInt(reported, 10, 64)
+	if err != nil || actualCost < 0 {
+		ErrorLogger.Printf("Backend reported invalid cost %q for %s %s", reported, resp.Request.Method, resp.Request.URL.Path)
+		return nil
+	}
+
+	extra := actualCost - state.limitReq.Units()
+	if extra <= 0 {
+		return nil
+	}
+
+	// Deliberately not the request context - the client going away doesn't cancel the bill
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, check := range state.checks {
+		debitReq := *check.Request
+		debitReq.Cost = extra
+		if err := check.Limiter.Consume(ctx, &debitReq); err != nil {
+			ErrorLogger.Printf("Unable to debit %d units from %s for account %d: %v", extra, debitReq.Policy, state.limitReq.AccountID, err)
+		}
+	}
+	InfoLogger.Printf("Debited %d extra units for account %d on %s", extra, state.limitReq.AccountID, resp.Request.URL.Path)
+	return nil
+}
@@ -10,17 +10,17 @@ ENV_FILE="$(dirname "$0")/.env"
 echo "Generating environment file for docker-compose..."
 
 # Generate random Redis password if not exists
-if [ ! -f "$ENV_FILE" ] || ! grep -q "redis_password=" "$ENV_FILE" 2>/dev/null; then
+if [ ! -f "$ENV_FILE" ] || ! grep -q "^redis_password=" "$ENV_FILE" 2>/dev/null; then
     REDIS_PASSWORD=$(openssl rand -base64 32 | tr -d "=+/" | cut -c1-25)
 else
-    REDIS_PASSWORD=$(grep "redis_password=" "$ENV_FILE" | cut -d'=' -f2)
+    REDIS_PASSWORD=$(grep "^redis_password=" "$ENV_FILE" | cut -d'=' -f2)
 fi
 
 # Generate random JWT secret if not exists  
-if [ ! -f "$ENV_FILE" ] || ! grep -q "JWT_SECRET=" "$ENV_FILE" 2>/dev/null; then
+if [ ! -f "$ENV_FILE" ] || ! grep -q "^JWT_SECRET=" "$ENV_FILE" 2>/dev/null; then
     JWT_SECRET=$(openssl rand -base64 64 | tr -d "=+/" | cut -c1-64)
 else
-    JWT_SECRET=$(grep "JWT_SECRET=" "$ENV_FILE" | cut -d'=' -f2)
+    JWT_SECRET=$(grep "^JWT_SECRET=" "$ENV_FILE" | cut -d'=' -f2)
 fi
 
 # Write .env file
@@ -33,6 +33,10 @@ redis_password=$REDIS_PASSWORD
 
 # JWT Configuration  
 JWT_SECRET=$JWT_SECRET
+
+# The same, by the names the proxy reads when run outside Docker (go run . loads this file)
+RL_REDIS_CONFIG__REDIS_PASSWORD=$REDIS_PASSWORD
+RL_JWT_SECRET=$JWT_SECRET
 EOF
 
 echo "Environment file created: $ENV_FILE"
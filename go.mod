@@ -2,11 +2,15 @@ module rate-limiter
 
 go 1.24.4
 
-require github.com/redis/go-redis/v9 v9.11.0
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/golang-jwt/jwt/v5 v5.2.2
+	github.com/joho/godotenv v1.5.1
+	github.com/redis/go-redis/v9 v9.11.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.2 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 )
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"rate-limiter/config"
+	"rate-limiter/types"
+	"strings"
+	"time"
+)
+
+// setRateLimitHeaders tells the client where it stands, in whichever style(s) are configured
+func (prox *RateLimitingProxy) setRateLimitHeaders(wtr http.ResponseWriter, result *types.RateLimitResult) {
+	style := prox.config.RateLimitHeaders
+	if style == config.HeadersLegacy || style == config.HeadersBoth {
+		setLegacyHeaders(wtr, result)
+	}
+	if style == config.HeadersStandard || style == config.HeadersBoth {
+		prox.setStandardHeaders(wtr, result)
+	}
+}
+
+// Legacy headers only describe the most restrictive limit
+func setLegacyHeaders(wtr http.ResponseWriter, result *types.RateLimitResult) {
+	if result.Limit > 0 {
+		wtr.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", result.Limit))
+		wtr.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", result.ResetTime.Unix()))
+	}
+
+	if result.Remaining >= 0 {
+		wtr.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", result.Remaining))
+	}
+}
+
+// setStandardHeaders writes the IETF httpapi RateLimit-Policy / RateLimit fields, one list member per limit, eg
+//
+//	RateLimit-Policy: "burst";q=10;w=1;qu="requests", "daily";q=50000;w=86400;qu="requests"
+//	RateLimit: "burst";r=3;t=1, "daily";r=41212;t=5230
+func (prox *RateLimitingProxy) setStandardHeaders(wtr http.ResponseWriter, result *types.RateLimitResult) {
+	policies := result.Policies
+	if len(policies) == 0 {
+		policies = []*types.RateLimitResult{result}
+	}
+
+	weighted := prox.weightedCosts()
+	var policyFields, limitFields []string
+	for _, policy := range policies {
+		if policy.Limit <= 0 { // Unlimited - nothing to describe
+			continue
+		}
+		name := sfString(policy.Policy)
+
+		policyField := fmt.Sprintf("%s;q=%d", name, policy.Limit)
+		if policy.Window > 0 {
+			policyField += fmt.Sprintf(";w=%d", int64(policy.Window.Seconds()))
+		}
+		if !weighted {
+			policyField += `;qu="requests"`
+		}
+		policyFields = append(policyFields, policyField)
+
+		reset := max(int64(math.Ceil(time.Until(policy.ResetTime).Seconds())), 0)
+		limitFields = append(limitFields, fmt.Sprintf("%s;r=%d;t=%d", name, max(policy.Remaining, 0), reset))
+	}
+
+	if len(policyFields) > 0 {
+		wtr.Header().Set("RateLimit-Policy", strings.Join(policyFields, ", "))
+		wtr.Header().Set("RateLimit", strings.Join(limitFields, ", "))
+	}
+}
+
+// weightedCosts is true when some requests cost more than others. The draft's quota units (requests, content-bytes,
+// concurrent-requests) have nothing for cost units, so qu is left off then, rather than claiming the quota is in requests
+func (prox *RateLimitingProxy) weightedCosts() bool {
+	costs := prox.config.CostConfig
+	if costs.DefaultCost != 1 {
+		return true
+	}
+	for _, cost := range costs.MethodCosts {
+		if cost != 1 {
+			return true
+		}
+	}
+	for _, endpoint := range prox.config.Endpoints {
+		if endpoint.Cost > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// sfString quotes a structured field string (RFC 8941)
+func sfString(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	return `"` + strings.ReplaceAll(val, `"`, `\"`) + `"`
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"rate-limiter/config"
+	"rate-limiter/metrics"
+	"sync"
+	"time"
+)
+
+var (
+	backendUp    = metrics.NewGauge("ratelimiter_backend_up", "Whether each backend target is passing health checks (1) or marked down (0)", "backend")
+	healthChecks = metrics.NewCounter("ratelimiter_backend_health_checks_total", "Active backend health checks, by target and result", "backend", "result")
+	backendDowns = metrics.NewCounter("ratelimiter_backend_unavailable_total", "Requests answered with a 503 because every backend target was marked down or had its circuit open")
+)
+
+// Backend states
+const (
+	backendStateUnknown = "unknown" // Not checked yet
+	backendStateUp      = "up"
+	backendStateDown    = "down"
+)
+
+// healthChecker probes a backend target in the background, so /health answers from the last result rather than making a
+// (possibly hanging) call of its own, and requests to a dead backend fail fast instead of waiting to time out.
+//
+// Requests that get no response at all count as failures too, so a backend that dies between checks is ejected
+// after the same number of failures in a row. Only a passing check brings it back
+type healthChecker struct {
+	url       string
+	name      string // The target it checks, credentials stripped - for logs and metrics
+	settings  config.HealthCheckConfig
+	client    *http.Client
+	stop      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+
+	mu         sync.RWMutex
+	state      string
+	passes     int // In a row
+	failures   int // In a row
+	lastCheck  time.Time
+	lastError  string
+	stateSince time.Time
+	recovered  bool // Up again after being down - it's warming up until slow start has passed
+}
+
+type healthStatus struct {
+	Target      string    `json:"target"`
+	Status      string    `json:"status"`  // healthy or unhealthy
+	Backend     string    `json:"backend"` // up, down or unknown
+	Since       time.Time `json:"since"`   // When the backend went into this state
+	LastCheck   time.Time `json:"last_check,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Failures    int       `json:"consecutive_failures"`
+	CheckPeriod string    `json:"check_interval"`
+	Circuit     string    `json:"circuit"` // The target's circuit breaker - closed, open, half_open or disabled
+	InFlight    int64     `json:"in_flight"`
+	Share       float64   `json:"share"` // Of its usual traffic - below 1 while it's slow starting
+}
+
+func newHealthChecker(url, name string, settings config.HealthCheckConfig) *healthChecker {
+	return &healthChecker{
+		url:        url,
+		name:       name,
+		settings:   settings,
+		client:     &http.Client{Timeout: settings.Timeout},
+		stop:       make(chan struct{}),
+		state:      backendStateUnknown,
+		stateSince: time.Now(),
+	}
+}
+
+// matches reports whether the checker is already checking what's asked for - so a reload can keep it, history and all
+func (health *healthChecker) matches(url string, settings config.HealthCheckConfig) bool {
+	return health.url == url && health.settings == settings
+}
+
+// Start checks straight away, then every interval until Stop. Starting again does nothing
+func (health *healthChecker) Start() {
+	health.startOnce.Do(func() { go health.run() })
+}
+
+func (health *healthChecker) run() {
+	ticker := time.NewTicker(health.settings.Interval)
+	defer ticker.Stop()
+	for {
+		health.check()
+		select {
+		case <-ticker.C:
+		case <-health.stop:
+			return
+		}
+	}
+}
+
+func (health *healthChecker) Stop() {
+	health.stopOnce.Do(func() { close(health.stop) })
+}
+
+func (health *healthChecker) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), health.settings.Timeout)
+	defer cancel()
+
+	err := health.probe(ctx)
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.lastCheck = time.Now()
+	if err != nil {
+		healthChecks.Inc(health.name, "failure")
+		health.lastError = err.Error()
+		health.recordFailure("health check failed: "+err.Error(), true)
+		return
+	}
+	healthChecks.Inc(health.name, "success")
+	health.lastError = ""
+	health.recordPass()
+}
+
+func (health *healthChecker) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, health.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := health.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // So the connection can be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("backend returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ProxyFailed counts a request that got no response from the backend
+func (health *healthChecker) ProxyFailed(err error) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.recordFailure("request failed: "+err.Error(), false)
+}
+
+// ProxyResponded breaks a run of failed requests - any response at all means the backend is there
+func (health *healthChecker) ProxyResponded() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if health.state != backendStateDown {
+		health.failures = 0 // Coming back up is for the checks to decide
+	}
+}
+
+// The first check decides an unknown backend either way; after that it takes a run of them to flip
+func (health *healthChecker) recordPass() {
+	health.failures = 0
+	health.passes++
+	if health.state == backendStateUnknown || (health.state == backendStateDown && health.passes >= health.settings.HealthyThreshold) {
+		health.setState(backendStateUp, "")
+	}
+}
+
+// A failed request isn't a check - one transport error at startup doesn't get to decide an unknown backend by itself
+func (health *healthChecker) recordFailure(reason string, fromCheck bool) {
+	health.passes = 0
+	health.failures++
+	if (health.state == backendStateUnknown && fromCheck) || (health.state != backendStateDown && health.failures >= health.settings.UnhealthyThreshold) {
+		health.setState(backendStateDown, reason)
+	}
+}
+
+func (health *healthChecker) setState(state, reason string) {
+	if state == health.state {
+		return
+	}
+	if state == backendStateDown {
+		ErrorLogger.Printf("Backend %s marked down (%d failures in a row) - %s", health.name, health.failures, reason)
+		backendUp.Set(0, health.name)
+	} else {
+		InfoLogger.Printf("Backend %s marked up", health.name)
+		backendUp.Set(1, health.name)
+	}
+	health.recovered = health.state == backendStateDown
+	health.state = state
+	health.stateSince = time.Now()
+}
+
+// Down is true only once the backend has been marked down - an unchecked backend gets the benefit of the doubt
+func (health *healthChecker) Down() bool {
+	health.mu.RLock()
+	defer health.mu.RUnlock()
+	return health.state == backendStateDown
+}
+
+// Ready is true once the backend has passed a check and hasn't been marked down since
+func (health *healthChecker) Ready() bool {
+	health.mu.RLock()
+	defer health.mu.RUnlock()
+	return health.state == backendStateUp
+}
+
+// Share is how much of its usual traffic the target should get - ramping from 0 to 1 over slowStart after it
+// recovers, so a cold replica isn't hit with a full share at once. It's 0 while down
+func (health *healthChecker) Share(slowStart time.Duration) float64 {
+	health.mu.RLock()
+	defer health.mu.RUnlock()
+	if health.state == backendStateDown {
+		return 0
+	}
+	if !health.recovered || slowStart <= 0 {
+		return 1
+	}
+	return min(1, float64(time.Since(health.stateSince))/float64(slowStart))
+}
+
+func (health *healthChecker) Status() healthStatus {
+	health.mu.RLock()
+	defer health.mu.RUnlock()
+	status := "unhealthy"
+	if health.state == backendStateUp {
+		status = "healthy"
+	}
+	return healthStatus{
+		Target:      health.name,
+		Status:      status,
+		Backend:     health.state,
+		Since:       health.stateSince,
+		LastCheck:   health.lastCheck,
+		LastError:   health.lastError,
+		Failures:    health.failures,
+		CheckPeriod: health.settings.Interval.String(),
+	}
+}
+
+// handleHealth reports the backend's state as of the last checks - it never calls the backend itself
+func (prox *RateLimitingProxy) handleHealth(wtr http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	if !prox.backends.Ready() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(wtr, status, prox.backends.Status())
+}
+
+// handleLiveness says the proxy process is up and serving - whatever the backend is doing. Restarting us won't fix it
+func (prox *RateLimitingProxy) handleLiveness(wtr http.ResponseWriter, req *http.Request) {
+	writeJSON(wtr, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// handleReadiness says whether we can usefully take traffic - ie some backend target is up
+func (prox *RateLimitingProxy) handleReadiness(wtr http.ResponseWriter, req *http.Request) {
+	if !prox.backends.Ready() {
+		writeJSON(wtr, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "backend": prox.backends.Status().Backend})
+		return
+	}
+	writeJSON(wtr, http.StatusOK, map[string]string{"status": "ready", "backend": backendStateUp})
+}
+
+// rejectBackendDown answers 503 when no backend target will take the request - marked down, or circuit open.
+// It's done before the request is counted against any limits (or dialed), since it can't be served anyway
+func rejectBackendDown(wtr http.ResponseWriter, req *http.Request, backends *backendPool) {
+	backendDowns.Inc()
+	retryAfter := int64(math.Ceil(backends.RetryAfter().Seconds()))
+	wtr.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+	prob := newProblem(http.StatusServiceUnavailable, problemBackendDown, "Backend Service is not available",
+		"The backend is failing health checks, or failing requests")
+	prob.RetryAfter = &retryAfter
+	writeProblem(wtr, req, prob)
+}
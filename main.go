@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"rate-limiter/clientip"
 	"rate-limiter/config"
+	"rate-limiter/metrics"
 	"rate-limiter/ratelimiter"
+	"rate-limiter/redact"
+	"rate-limiter/revocation"
+	"rate-limiter/types"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	_ "time/tzdata" // Quotas reset in customer timezones - the runtime image has no zoneinfo
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -33,41 +41,86 @@ type JWTClaims struct {
 	AccountID            int64  `json:"account_id"` // Account ID for rate limiting
 	UserID               string `json:"sub"`        // Subject - user identifier
 	Role                 string `json:"role"`       // User role (e.g., "admin", "user")
+	Priority             string `json:"priority"`   // Priority class (low, normal, high) - optional
 	jwt.RegisteredClaims        // Standard JWT claims (exp, iat, etc.)
 }
 
 type RateLimitingProxy struct {
-	rateLimiter           ratelimiter.RateLimiter
-	config                *config.Config
-	backendURL            string
-	backendHealthcheckURL string
-	reverseProxy          httputil.ReverseProxy
+	rateLimiter     ratelimiter.RateLimiter                           // The global algorithm
+	limiters        map[ratelimiter.Algorithm]ratelimiter.RateLimiter // Every algorithm in use, including the global one
+	revocations     *revocation.Store
+	clientIPs       *clientip.Resolver
+	priorityCallers *clientip.Resolver // Callers allowed to set the priority header
+	concurrency     *ratelimiter.ConcurrencyLimiter
+	adaptive        *ratelimiter.AdaptiveController // nil when adaptive limits are off
+	throttleQueue   chan struct{}                   // One slot per request waiting on a throttled endpoint
+	config          *config.Config
+	backends        *backendPool // Targets outlive reloads, health history and all, unless they're changed
+	reverseProxy    httputil.ReverseProxy
+	handler         http.Handler // Routes to the handlers below - swapped out whole on config reload
 }
 
-// Impl
+// What the proxy knows about a request it's forwarding - carried on the request context so the
+// (shared) Director and ModifyResponse hooks can see it
+type proxiedRequest struct {
+	limitReq   *types.RateLimitRequest
+	checks     []ratelimiter.LimitCheck // The limits the request was counted against
+	upstream   *upstream                // The backend target it's going to - a retry may pick another
+	policy     config.UpstreamPolicy    // Timeouts and retries for the route
+	inboundURL *url.URL                 // As the client sent it - retries re-target from this
+	started    time.Time                // When we started forwarding - backend latency feeds the adaptive limits
+}
 
-func init() {
-	log.Println("DEBUG: init() function called")
+type proxiedRequestKey struct{}
 
-	// Load .env file if it exists
-	if err := godotenv.Load("./docker/.env"); err != nil {
-		log.Printf("DEBUG: godotenv.Load failed: %v", err)
-		log.Println("No .env file found, using system environment variables")
-	} else {
-		log.Println("DEBUG: Successfully loaded .env file")
-	}
+func proxiedRequestFrom(ctx context.Context) (*proxiedRequest, bool) {
+	state, ok := ctx.Value(proxiedRequestKey{}).(*proxiedRequest)
+	return state, ok
 }
 
+// Impl
+
+// Every package's loggers write through these (see setLogLevel), so secrets are masked wherever they turn up
+var (
+	logStdout = redact.NewWriter(os.Stdout)
+	logStderr = redact.NewWriter(os.Stderr)
+)
+
 // Application-wide logger
 var (
-	InfoLogger  = log.New(os.Stdout, "[MAIN] INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	ErrorLogger = log.New(os.Stderr, "[MAIN] ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	InfoLogger  = log.New(logStdout, "[MAIN] INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+	ErrorLogger = log.New(logStderr, "[MAIN] ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
+var shadowDenials = metrics.NewCounter("ratelimiter_shadow_denied_total", "Requests a shadow (non-enforced) limit would have denied", "policy")
+
+var backendResponses = metrics.NewCounter("ratelimiter_backend_responses_total", "Responses from the backend by status class - 'error' is no response at all", "class")
+
 func main() {
+	opts, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setLogLevel(opts.logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := loadEnvFile(opts); err != nil {
+		ErrorLogger.Fatal(err)
+	}
+	config.AllowDefaultSecrets = opts.dev
+
+	if opts.command == "validate" {
+		os.Exit(runValidate(opts))
+	}
+
 	InfoLogger.Println("Starting rate-limiter proxy...")
 
-	cfg, err := loadConfig()
+	cfg, err := loadConfig(opts)
 	if err != nil {
 		ErrorLogger.Fatal("Failed to load configuration:", err)
 	}
@@ -79,39 +132,67 @@ func main() {
 		ErrorLogger.Fatal(err)
 	}
 
-	err = startServer(cfg, client)
+	err = startServer(cfg, client, opts)
 	if err != nil {
 		ErrorLogger.Fatal("Unable to start server", err)
 	}
 
 	InfoLogger.Println("Rate-limiter proxy started successfully")
-
-	// Step 5: Handle graceful shutdown (future)
-	// setupGracefulShutdown()
 }
 
-// loadConfig loads configuration from file/env and validates it
-func loadConfig() (*config.Config, error) {
+// loadConfig loads configuration from file/env, applies command line over-rides, and validates it.
+// An invalid config is still returned alongside the error, so it can be printed
+func loadConfig(opts *cliOptions) (*config.Config, error) {
 	InfoLogger.Println("Loading configuration...")
 
-	cfg, err := config.Load("")
+	cfg, err := config.Load(opts.configPath)
+	maskLogSecrets(cfg) // Before anything else can log them - even a config that fails validation
+	if opts.port > 0 {
+		cfg.ServerConfig.Port = opts.port // Flags beat env vars beat the file
+		if cfg.Sources != nil {
+			cfg.Sources["server_config.port"] = config.SourceFlag
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to load config: %w", err)
+		return cfg, fmt.Errorf("failed to load config: %w", err)
 	}
 	InfoLogger.Println("Configuration loaded and validated successfully")
 	return cfg, nil
 }
 
+// maskLogSecrets has every log line mask the config's secrets from now on
+func maskLogSecrets(cfg *config.Config) {
+	secrets := cfg.Secrets()
+	logStdout.Mask(secrets...)
+	logStderr.Mask(secrets...)
+}
+
 // printConfigSummary prints a summary of loaded config for debugging
 func printConfigSummary(cfg *config.Config) {
 	InfoLogger.Println("#### Configuration Summary ####")
-	InfoLogger.Printf("\t\tBackend URL: %s", cfg.BackendConfig.URL)
+	if len(cfg.BackendConfig.Targets) == 0 {
+		InfoLogger.Printf("\t\tBackend URL: %s", redact.URL(cfg.BackendConfig.URL))
+	} else {
+		for _, target := range cfg.BackendConfig.Targets {
+			InfoLogger.Printf("\t\tBackend Target: %s (%s)", redact.URL(target.URL), cfg.BackendConfig.LoadBalancing)
+		}
+	}
 	InfoLogger.Printf("\t\tServer Port: %d", cfg.ServerConfig.Port)
+	if cfg.TLSConfig.Enabled() {
+		InfoLogger.Printf("\t\tTLS: %s (min %s, client certs %s)", cfg.TLSConfig.CertFile, cfg.TLSConfig.MinVersion, cfg.TLSConfig.ClientAuth)
+	}
 	InfoLogger.Printf("\t\tDefault Rate Limit: %d requests per %s",
 		cfg.DefaultlimitCount, cfg.DefaultPeriod)
-	InfoLogger.Printf("\t\tMongoDB URL: %s", sanitizeURL(cfg.MongoURL))
-	InfoLogger.Printf("\t\tRedis URL: %s", sanitizeURL(cfg.RedisConfig.URL))
+	InfoLogger.Printf("\t\tMongoDB URL: %s", redact.URL(cfg.MongoURL))
+	InfoLogger.Printf("\t\tRedis URL: %s", redact.URL(cfg.RedisConfig.URL))
 	InfoLogger.Printf("\t\tRatelimiting Algorithm: %s", cfg.LimitingAlgorithm)
+	for _, limit := range cfg.Limits {
+		mode := "enforced"
+		if !limit.Enforce {
+			mode = "shadow"
+		}
+		InfoLogger.Printf("\t\tLimit %s: %d requests per %s (per %s, %s)", limit.Name, limit.LimitCount, limit.Period, limit.Scope, mode)
+	}
 
 	// Print server timeouts
 	InfoLogger.Printf("\t\tServer Timeouts - Read: %s, Write: %s, Idle: %s",
@@ -124,115 +205,220 @@ func printConfigSummary(cfg *config.Config) {
 		InfoLogger.Printf("\t\tJWT Secret: [NOT CONFIGURED]")
 	}
 
+	InfoLogger.Printf("\t\tConfig Hash: %s", cfg.Hash())
 	InfoLogger.Println("#### End Configuration Summary ####")
 }
 
+// redisCredentials hands each new Redis connection the current username and password, so a rotated password
+// is picked up on reload without a restart. Connections already open carry on with the one they logged in with
+type redisCredentials struct {
+	current atomic.Pointer[[2]string]
+}
+
+var redisAuth = &redisCredentials{}
+
+func (creds *redisCredentials) Set(redisConfig config.RedisConfig) {
+	creds.current.Store(&[2]string{redisConfig.Username, redisConfig.Password})
+}
+
+func (creds *redisCredentials) Credentials() (string, string) {
+	current := creds.current.Load()
+	return current[0], current[1]
+}
+
 // initializeStorage sets up MongoDB and Redis connections
 func initializeStorage(cfg *config.Config) (*redis.Client, error) {
 	InfoLogger.Println("Initializing storage connections...")
 
-	var redisClient *redis.Client
-
-	if cfg.RedisConfig.Username != "" {
-		redisClient = redis.NewClient(&redis.Options{
-			Addr:     cfg.RedisConfig.URL,
-			Password: cfg.RedisConfig.Password,
-			DB:       cfg.RedisConfig.DB,
-			Username: cfg.RedisConfig.Username,
-		})
-	} else {
-		redisClient = redis.NewClient(&redis.Options{
-			Addr:     cfg.RedisConfig.URL,
-			Password: cfg.RedisConfig.Password,
-			DB:       cfg.RedisConfig.DB,
-		})
-	}
+	redisAuth.Set(cfg.RedisConfig)
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:                cfg.RedisConfig.URL,
+		DB:                  cfg.RedisConfig.DB,
+		CredentialsProvider: redisAuth.Credentials,
+	})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	_, err := redisClient.Ping(ctx).Result()
 	if err != nil {
-		return nil, fmt.Errorf("Unable to reach Redis service at %s : %s", sanitizeURL(cfg.RedisConfig.URL), err)
+		return nil, fmt.Errorf("Unable to reach Redis service at %s : %s", redact.URL(cfg.RedisConfig.URL), err)
 	}
 
 	InfoLogger.Println("Storage connections initialized successfully")
 	return redisClient, nil
 }
 
-func setupProxy(cfg *config.Config, rateLimiter ratelimiter.RateLimiter) (*RateLimitingProxy, error) {
-	// Set up the backend URL
+func setupProxy(cfg *config.Config, limiters map[ratelimiter.Algorithm]ratelimiter.RateLimiter, revocations *revocation.Store,
+	concurrency *ratelimiter.ConcurrencyLimiter, adaptive *ratelimiter.AdaptiveController, oldBackends *backendPool) (*RateLimitingProxy, error) {
 	// -- TODO FUTURE -- Extend this with a ChooseBackend function based on inbound host
-	backendURL, err := url.Parse(cfg.BackendConfig.URL)
+	backends, err := newBackendPool(cfg, oldBackends)
 	if err != nil {
-		return nil, fmt.Errorf("Invalid backend URL %s: %v", cfg.BackendConfig.URL, err)
+		return nil, err
 	}
 
-	revProx := httputil.NewSingleHostReverseProxy(backendURL)
+	clientIPs, err := clientip.NewResolver(cfg.AnonymousConfig.TrustedProxies, cfg.AnonymousConfig.ForwardedHeader,
+		cfg.AnonymousConfig.IPv4PrefixLength, cfg.AnonymousConfig.IPv6PrefixLength)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid anonymous client configuration: %v", err)
+	}
+
+	// Only the trusted list matters here - prefix lengths are for aggregating anonymous callers
+	priorityCallers, err := clientip.NewResolver(cfg.PriorityConfig.TrustedCallers, cfg.AnonymousConfig.ForwardedHeader, 32, 128)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid priority configuration: %v", err)
+	}
+
+	revProx := &httputil.ReverseProxy{Transport: &upstreamTransport{backends: backends}}
+	revProx.Director = func(req *http.Request) {
+		upstream := backends.upstreams[0] // Only if the request wasn't picked a target - it always is
+		if state, ok := proxiedRequestFrom(req.Context()); ok {
+			upstream = state.upstream
+		}
+		upstream.director(req)
+		req.Header.Set("X-Forwarded-By", "rate-limiter-proxy")
+		req.Header.Set("X-Proxy-Version", "1.0")
+		req.Header.Del("X-Account-ID") // Never pass along a client-supplied account
+		if state, ok := proxiedRequestFrom(req.Context()); ok {
+			req.Header.Set("X-Account-ID", fmt.Sprintf("%d", state.limitReq.AccountID))
+		}
+		InfoLogger.Printf("Forwarding %s %s to %s", req.Method, req.URL.Path, redact.URL(req.URL.String()))
+	}
 
 	revProx.ErrorHandler = func(wtr http.ResponseWriter, req *http.Request, err error) {
+		if errors.Is(err, errCircuitOpen) {
+			rejectBackendDown(wtr, req, backends) // Never dialed - nothing for the logs or the adaptive limits
+			return
+		}
 		ErrorLogger.Printf("Proxy error for %s, %s: %v", req.Method, req.URL.Path, err)
-		http.Error(wtr, "Backend Service is not available", http.StatusBadGateway)
+		backendResponses.Inc("error")
+		if state, ok := proxiedRequestFrom(req.Context()); ok {
+			adaptive.Observe(0, time.Since(state.started))
+		}
+		if isTimeout(err) {
+			writeProblem(wtr, req, newProblem(http.StatusGatewayTimeout, problemGatewayTimeout, "Backend Service timed out", "The backend did not respond in time"))
+			return
+		}
+		writeProblem(wtr, req, newProblem(http.StatusBadGateway, problemBadGateway, "Backend Service is not available", "The backend did not respond"))
 	}
 
 	proxy := &RateLimitingProxy{
-		rateLimiter:           rateLimiter,
-		config:                cfg,
-		backendURL:            cfg.BackendConfig.URL,
-		backendHealthcheckURL: cfg.BackendConfig.HealthcheckURL,
-		reverseProxy:          *revProx,
-	}
+		throttleQueue:   make(chan struct{}, cfg.ThrottleConfig.QueueSize),
+		rateLimiter:     limiters[cfg.LimitingAlgorithm],
+		limiters:        limiters,
+		revocations:     revocations,
+		clientIPs:       clientIPs,
+		priorityCallers: priorityCallers,
+		concurrency:     concurrency,
+		adaptive:        adaptive,
+		config:          cfg,
+		backends:        backends,
+	}
+	revProx.ModifyResponse = proxy.handleBackendResponse
+	proxy.reverseProxy = *revProx
+	proxy.handler = proxy.routes()
 	return proxy, nil
 }
 
+// routes muxes the endpoints the proxy serves itself, and everything else to the backend
+func (prox *RateLimitingProxy) routes() http.Handler {
+	// We need muxing to trap *all* requests
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", prox.anonymousLimited(prox.handleHealth)) // We're going to have a simple health endpoint for kube
+	mux.HandleFunc("/livez", prox.handleLiveness)                       // Probes aren't rate limited - a 429 would look like an outage
+	mux.HandleFunc("/readyz", prox.handleReadiness)
+	mux.HandleFunc("/admin/revocations", prox.adminOnly(prox.handleRevocations))
+	mux.HandleFunc("/admin/quotas", prox.adminOnly(prox.handleQuotaUsage))
+	mux.HandleFunc("/admin/adaptive", prox.adminOnly(prox.handleAdaptive))
+	mux.HandleFunc("/admin/config", prox.adminOnly(prox.handleConfig))
+	mux.HandleFunc("/metrics", prox.anonymousLimited(metrics.Handler()))
+	mux.HandleFunc("/", prox.handleRequest) // Everything else is rate-limited
+	return mux
+}
+
+// buildLimiters creates one limiter per algorithm in use - the global one, plus any individual limits over-ride
+func buildLimiters(cfg *config.Config, redClient *redis.Client) (map[ratelimiter.Algorithm]ratelimiter.RateLimiter, error) {
+	algorithms := []ratelimiter.Algorithm{cfg.LimitingAlgorithm}
+	for _, limit := range cfg.Limits {
+		algorithms = append(algorithms, cfg.AlgorithmFor(limit))
+	}
+
+	limiters := make(map[ratelimiter.Algorithm]ratelimiter.RateLimiter)
+	for _, alg := range algorithms {
+		if _, exists := limiters[alg]; exists {
+			continue
+		}
+		limiter, err := ratelimiter.NewRateLimiter(alg, redClient, cfg.DefaultPeriod, cfg.DefaultlimitCount)
+		if err != nil {
+			return nil, err
+		}
+		limiters[alg] = limiter
+	}
+	return limiters, nil
+}
+
 // startServer starts the HTTP proxy server
-func startServer(cfg *config.Config, redClient *redis.Client) error {
+func startServer(cfg *config.Config, redClient *redis.Client, opts *cliOptions) error {
 	InfoLogger.Printf("Starting HTTP server on port %d...", cfg.ServerConfig.Port)
-	rateLimiter, err := ratelimiter.NewRateLimiter(cfg.LimitingAlgorithm, redClient, cfg.DefaultPeriod, cfg.DefaultlimitCount)
+	limiters, err := buildLimiters(cfg, redClient)
 	if err != nil {
-		ErrorLogger.Fatalf("Unable to load RateLimiter", err)
+		ErrorLogger.Fatalf("Unable to load RateLimiter: %v", err)
 	}
 
-	proxy, err := setupProxy(cfg, rateLimiter)
+	revocations := revocation.NewStore(redClient, cfg.RevocationConfig.CacheTTL, cfg.RevocationConfig.CacheSize)
+
+	concurrency := ratelimiter.NewConcurrencyLimiter(redClient, cfg.ConcurrencyConfig.LeaseTTL)
+
+	var adaptive *ratelimiter.AdaptiveController
+	if cfg.AdaptiveConfig.Enabled {
+		adaptive = ratelimiter.NewAdaptiveController(redClient, ratelimiter.AdaptiveSettings{
+			Interval:                 cfg.AdaptiveConfig.Interval,
+			ErrorRateThreshold:       cfg.AdaptiveConfig.ErrorRateThreshold,
+			UnavailableRateThreshold: cfg.AdaptiveConfig.UnavailableRateThreshold,
+			LatencyThreshold:         cfg.AdaptiveConfig.LatencyThreshold,
+			IncreaseStep:             cfg.AdaptiveConfig.IncreaseStep,
+			DecreaseFactor:           cfg.AdaptiveConfig.DecreaseFactor,
+			MinMultiplier:            cfg.AdaptiveConfig.MinMultiplier,
+			MinSamples:               cfg.AdaptiveConfig.MinSamples,
+		})
+		adaptive.Start()
+	}
+
+	proxy, err := setupProxy(cfg, limiters, revocations, concurrency, adaptive, nil)
 	if err != nil {
-		ErrorLogger.Fatalf("Unable to set up reverse proxy", err)
+		ErrorLogger.Fatalf("Unable to set up reverse proxy: %v", err)
 	}
+	proxy.backends.Start()
 
-	// We need muxing to trap *all* requests
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", proxy.handleHealth) // We're going to have a simple health endpoint for kube
-	mux.HandleFunc("/", proxy.handleRequest)      // Everything else is rate-limited
+	reloads := newReloader(opts, proxy, redClient)
+	reloads.Start()
 
 	server := &http.Server{
 		Addr:         ":" + strconv.Itoa(cfg.ServerConfig.Port),
-		Handler:      mux,
+		Handler:      withRequestID(reloads),
 		ReadTimeout:  cfg.ServerConfig.ReadTimeout,
 		IdleTimeout:  cfg.ServerConfig.IdleTimeout,
 		WriteTimeout: cfg.ServerConfig.WriteTimeout,
+		Protocols:    new(http.Protocols),
 	}
+	server.Protocols.SetHTTP1(true)
 
-	InfoLogger.Printf("HTTP server listening on port %d", cfg.ServerConfig.Port)
-	return server.ListenAndServe() // This blocks until server stops
-}
-
-func (prox *RateLimitingProxy) handleHealth(wtr http.ResponseWriter, req *http.Request) {
-	resp, err := http.Get(prox.backendHealthcheckURL)
-	if err != nil {
-		ErrorLogger.Printf("Backend health check failed: %v", err)
-		http.Error(wtr, "Backend unhealthy", http.StatusServiceUnavailable)
-		return
+	if !cfg.TLSConfig.Enabled() {
+		server.Protocols.SetUnencryptedHTTP2(cfg.ServerConfig.H2C) // Prior knowledge only - there's no Upgrade dance
+		InfoLogger.Printf("HTTP server listening on port %d (h2c %t)", cfg.ServerConfig.Port, cfg.ServerConfig.H2C)
+		return server.ListenAndServe() // This blocks until server stops
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		ErrorLogger.Printf("Backend returned status %d", resp.StatusCode)
-		http.Error(wtr, "Backend unhealthy", http.StatusServiceUnavailable)
-		return
-	}
-
-	wtr.Header().Set("Content-Type", "application/json")
-	wtr.WriteHeader(http.StatusOK)
-	wtr.Write([]byte(`{"status": "healthy", "backend": "reachable"}`))
+	certs, err := newListenerCerts(cfg.TLSConfig)
+	if err != nil {
+		return err
+	}
+	certs.Start()
+	server.Protocols.SetHTTP2(cfg.ServerConfig.HTTP2)
+	server.TLSConfig = certs.TLSConfig(cfg.ServerConfig.HTTP2)
+	InfoLogger.Printf("HTTPS server listening on port %d (TLS %s+, client certs %s, HTTP/2 %t)", cfg.ServerConfig.Port,
+		cfg.TLSConfig.MinVersion, cfg.TLSConfig.ClientAuth, cfg.ServerConfig.HTTP2)
+	return server.ListenAndServeTLS("", "") // The cert and key come from TLSConfig, so they can be reloaded
 }
 
 func (prox *RateLimitingProxy) handleRequest(wtr http.ResponseWriter, req *http.Request) {
@@ -241,86 +427,229 @@ func (prox *RateLimitingProxy) handleRequest(wtr http.ResponseWriter, req *http.
 
 	authLevel := prox.determineAuthLevel(req.URL.Path)
 
-	// TODO: STEP 2 - Handle authentication based on the determined level
-	var accountId int64
+	var limitReq *types.RateLimitRequest
 	switch authLevel {
 	case AuthNone:
-		// Public path - no authentication required - This will be the same as the whitelist path - not limited either
-		// Things like healthcheck
-		accountId = -1
+		// Public path - no authentication required
+		// Things like healthcheck, and public catalog endpoints - these get limited per client IP instead
+		var err error
+		limitReq, err = prox.anonymousLimitRequest(req)
+		if err != nil {
+			ErrorLogger.Printf("Unable to identify anonymous client %s: %v", req.RemoteAddr, err)
+			writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemUnidentifiedUser, "Bad Request", "Unable to identify the client address"))
+			return
+		}
 	case AuthRequired:
 		// Standard authentication required
-		var err error
-		accountId, err = prox.validateJWT(req)
+		claims, err := prox.validateJWT(req)
 		if err != nil {
-			http.Error(wtr, "Unauthorized", http.StatusUnauthorized)
+			writeProblem(wtr, req, authProblem(err))
 			return
 		}
+		limitReq = prox.accountLimitRequest(claims, req)
 	case AdminRequired:
 		// Admin authentication required -
 		// Things like reset, add config, etc
-		var err error
-		accountId, err = prox.validateAdminJWT(req)
+		claims, err := prox.validateAdminJWT(req)
+		if err != nil {
+			writeProblem(wtr, req, authProblem(err))
+			return
+		}
+		limitReq = prox.accountLimitRequest(claims, req)
+	}
+
+	prox.processRequest(wtr, req, limitReq)
+}
+
+// accountLimitRequest builds the limit check for an authenticated account - configured defaults apply
+func (prox *RateLimitingProxy) accountLimitRequest(claims *JWTClaims, req *http.Request) *types.RateLimitRequest {
+	return &types.RateLimitRequest{
+		AccountID:   claims.AccountID,
+		Subject:     strconv.FormatInt(claims.AccountID, 10),
+		RequestPath: req.URL.Path,
+		Cost:        prox.requestCost(req),
+		Priority:    prox.requestPriority(req, claims.Priority),
+	}
+}
+
+// anonymousLimitRequest builds the limit check for unauthenticated traffic.
+// Every anonymous caller shares accountId -1, so they're told apart by client IP, and get their own (separate) limits
+func (prox *RateLimitingProxy) anonymousLimitRequest(req *http.Request) (*types.RateLimitRequest, error) {
+	identity, err := prox.clientIPs.Identity(req)
+	if err != nil {
+		return nil, err
+	}
+	priority := prox.requestPriority(req, "")
+	return &types.RateLimitRequest{
+		AccountID:   -1,
+		Subject:     "ip-" + identity,
+		Policy:      "anonymous",
+		RequestPath: req.URL.Path,
+		Limit:       prox.applyPriority(prox.adaptive.Apply(prox.config.AnonymousConfig.LimitCount), priority),
+		Period:      prox.config.AnonymousConfig.Period,
+		Cost:        prox.requestCost(req),
+		Priority:    priority,
+	}, nil
+}
+
+// limitChecks expands a request into one check per configured limit.
+// Anonymous traffic only has its own, single limit
+func (prox *RateLimitingProxy) limitChecks(limitReq *types.RateLimitRequest) []ratelimiter.LimitCheck {
+	if limitReq.AccountID < 0 {
+		return []ratelimiter.LimitCheck{{Limiter: prox.rateLimiter, Request: limitReq, Shadow: !prox.config.AnonymousConfig.Enforce}}
+	}
+
+	checks := make([]ratelimiter.LimitCheck, 0, len(prox.config.Limits))
+	for _, limit := range prox.config.Limits {
+		checkReq := *limitReq
+		checkReq.Policy = limit.Name
+		checkReq.Limit = limit.LimitCount
+		if prox.config.AlgorithmFor(limit) != ratelimiter.CalendarQuota { // Quotas are contractual - brownouts and priority shares don't shrink them
+			checkReq.Limit = prox.adaptive.Apply(limit.LimitCount)
+			checkReq.Limit = prox.applyPriority(checkReq.Limit, limitReq.Priority) // Lower classes stop short, leaving the rest for high
+		}
+
+		checkReq.Period = limit.Period
+		checkReq.Calendar = limit.Calendar
+		checkReq.Timezone = prox.config.TimezoneFor(limit, limitReq.AccountID)
+		if limit.Scope == config.ScopeAccount {
+			checkReq.RequestPath = "*" // One counter across every path
+		}
+		limiter := prox.limiters[prox.config.AlgorithmFor(limit)]
+		checks = append(checks, ratelimiter.LimitCheck{Limiter: limiter, Request: &checkReq, Shadow: !limit.Enforce})
+	}
+	return checks
+}
+
+// anonymousLimited wraps handlers the proxy serves itself (eg /health) in the anonymous limits
+func (prox *RateLimitingProxy) anonymousLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(wtr http.ResponseWriter, req *http.Request) {
+		limitReq, err := prox.anonymousLimitRequest(req)
 		if err != nil {
-			http.Error(wtr, "Unauthorized", http.StatusUnauthorized)
+			ErrorLogger.Printf("Unable to identify anonymous client %s: %v", req.RemoteAddr, err)
+			writeProblem(wtr, req, newProblem(http.StatusBadRequest, problemUnidentifiedUser, "Bad Request", "Unable to identify the client address"))
 			return
 		}
+		checks, ok := prox.awaitLimits(wtr, req, limitReq)
+		if !ok {
+			return
+		}
+		if _, ok := prox.enforceLimit(wtr, req, limitReq, checks); !ok {
+			return
+		}
+		next(wtr, req)
 	}
+}
+
+// awaitLimits works out the limits the request counts against, and holds it on a throttled endpoint until they'd let it
+// through. Nothing is counted yet. Returns false if the request has already been answered (the check failed)
+func (prox *RateLimitingProxy) awaitLimits(wtr http.ResponseWriter, req *http.Request, limitReq *types.RateLimitRequest) ([]ratelimiter.LimitCheck, bool) {
+	ctx, cancel := context.WithTimeout(req.Context(), 600*time.Second)
+	defer cancel()
 
-	prox.processRequest(wtr, req, accountId)
+	checks := prox.limitChecks(limitReq)
+	if err := prox.awaitCapacity(ctx, req, limitReq, checks); err != nil {
+		ErrorLogger.Printf("RateLimit check failed - AccountID: %d, Subject: %s, %v", limitReq.AccountID, limitReq.Subject, err)
+		writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemLimiterDown, "Rate Limiting Unavailable", "Unable to check rate limits"))
+		return nil, false
+	}
+	return checks, true
 }
 
-// TODO: STEP 4 - Move the existing rate limiting and proxy logic into this function
-func (prox *RateLimitingProxy) processRequest(wtr http.ResponseWriter, req *http.Request, accountId int64) {
+// enforceLimit runs the limit check and sets the limit headers.
+// Returns the limits the request was counted against, and false if the request has already been answered (limited, or the check failed)
+func (prox *RateLimitingProxy) enforceLimit(wtr http.ResponseWriter, req *http.Request, limitReq *types.RateLimitRequest, checks []ratelimiter.LimitCheck) ([]ratelimiter.LimitCheck, bool) {
 	// Call the rate limiter
 	//		if allowed - forward
 	//		if not, return 429
 	ctx, cancel := context.WithTimeout(req.Context(), 600*time.Second)
 	defer cancel()
 
-	result, err := prox.rateLimiter.CheckLimit(ctx, accountId, req.URL.Path)
+	result, err := ratelimiter.CheckLimits(ctx, checks)
 
 	// Fail closed
 	if err != nil { // If the check fails, fail closed
-		ErrorLogger.Printf("RateLimit check failed - AccountID: %d, %v", accountId, err)
-		http.Error(wtr, "Rate Limiting Unavailable", http.StatusInternalServerError)
-		return
+		ErrorLogger.Printf("RateLimit check failed - AccountID: %d, Subject: %s, %v", limitReq.AccountID, limitReq.Subject, err)
+		writeProblem(wtr, req, newProblem(http.StatusInternalServerError, problemLimiterDown, "Rate Limiting Unavailable", "Unable to check rate limits"))
+		return nil, false
 	}
 
-	// Add proxy headers for limit/remaining
-	if result.Limit > 0 {
-		wtr.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", result.Limit))
-	}
+	prox.setRateLimitHeaders(wtr, result)
 
-	if result.Remaining >= 0 {
-		wtr.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", result.Remaining))
+	// Limits being trialled - they'd have said no, but they don't get to yet
+	if len(result.ShadowDenied) > 0 {
+		InfoLogger.Printf("Shadow limit %s would have denied account %d (%s) on path %s", strings.Join(result.ShadowDenied, ", "), limitReq.AccountID, limitReq.Subject, req.URL.Path)
+		for _, policy := range result.ShadowDenied {
+			shadowDenials.Inc(policy)
+		}
+		wtr.Header().Set("X-RateLimit-Shadow-Denied", strings.Join(result.ShadowDenied, ", "))
 	}
 
 	// If the limiter says no...
 	if !result.Allowed {
-		InfoLogger.Printf("Rate limit exceeded for account %d on path %s", accountId, req.URL.Path)
+		InfoLogger.Printf("Rate limit %s exceeded for account %d (%s, %s priority) on path %s", result.Policy, limitReq.AccountID, limitReq.Subject, limitReq.Priority, req.URL.Path)
 
 		if result.RetryAfter >= 0 {
 			wtr.Header().Set("Retry-After", fmt.Sprintf("%.0f", result.RetryAfter.Seconds()))
 		}
-		http.Error(wtr, "Rate limit exceeded", http.StatusTooManyRequests)
+		writeProblem(wtr, req, rateLimitProblem(result))
+		return nil, false
+	}
+	return checks, true
+}
+
+// processRequest limits an authenticated (or anonymous) request and, if it gets through, proxies it to a backend
+func (prox *RateLimitingProxy) processRequest(wtr http.ResponseWriter, req *http.Request, limitReq *types.RateLimitRequest) {
+	upstream := prox.backends.Pick(limitReq)
+	if upstream == nil {
+		rejectBackendDown(wtr, req, prox.backends)
 		return
 	}
 
-	InfoLogger.Printf("Proxying request to backend - AccountID: %d, %s, %s", accountId, req.Method, req.URL.Path)
+	// A throttled request waits before it takes an in-flight slot - held requests shouldn't crowd out ones actually
+	// being served. The slot comes before the limits are counted, so a request turned away for concurrency hasn't used
+	// any of its rate limits or quotas. One turned away by those gives its slot straight back
+	checks, ok := prox.awaitLimits(wtr, req, limitReq)
+	if !ok {
+		return
+	}
+	lease, ok := prox.acquireLease(wtr, req, limitReq)
+	if !ok {
+		return
+	}
+	if lease != nil {
+		defer lease.Release() // ServeHTTP only returns once the response is done
+	}
 
-	originalDirector := prox.reverseProxy.Director
-	prox.reverseProxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		req.Header.Set("X-Forwarded-By", "rate-limiter-proxy")
-		req.Header.Set("X-Proxy-Version", "1.0")
-		req.Header.Set("X-Account-ID", fmt.Sprintf("%d", accountId))
-		InfoLogger.Printf("Forwarding %s %s to %s", req.Method, req.URL.Path, req.URL.String())
+	checks, ok = prox.enforceLimit(wtr, req, limitReq, checks)
+	if !ok {
+		return
 	}
 
+	InfoLogger.Printf("Proxying request to backend - AccountID: %d, %s, %s", limitReq.AccountID, req.Method, req.URL.Path)
+
+	policy := prox.upstreamFor(req)
+	ctx := req.Context()
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout) // Covers retries and reading the response
+		defer cancel()
+	}
+	inboundURL := *req.URL
+	state := &proxiedRequest{limitReq: limitReq, checks: checks, upstream: upstream, policy: policy, inboundURL: &inboundURL, started: time.Now()}
+	req = req.WithContext(context.WithValue(ctx, proxiedRequestKey{}, state))
 	prox.reverseProxy.ServeHTTP(wtr, req)
 }
 
+// handleBackendResponse sees every backend response before the client does
+func (prox *RateLimitingProxy) handleBackendResponse(resp *http.Response) error {
+	backendResponses.Inc(fmt.Sprintf("%dxx", resp.StatusCode/100))
+	if state, ok := proxiedRequestFrom(resp.Request.Context()); ok {
+		prox.adaptive.Observe(resp.StatusCode, time.Since(state.started))
+	}
+	return prox.debitReportedCost(resp)
+}
+
 func (prox *RateLimitingProxy) determineAuthLevel(path string) AuthLevel {
 	// First check if matches any admin paths - this over-rides everything, even if a path is configured for both
 	//
@@ -341,36 +670,44 @@ func (prox *RateLimitingProxy) determineAuthLevel(path string) AuthLevel {
 	return AuthRequired
 }
 
-func (prox *RateLimitingProxy) pathMatches(requestPath, configPath string) bool {
-	// Exact match
-	if requestPath == configPath {
-		return true
-	}
+// upstreamFor returns the timeouts and retries for a request - the first endpoint with an upstream section, over upstream_config
+func (prox *RateLimitingProxy) upstreamFor(req *http.Request) config.UpstreamPolicy {
+	endpoint, _ := prox.matchEndpoint(req, func(endpoint config.EndpointPolicy) bool { return endpoint.Upstream.IsSet() })
+	return prox.config.UpstreamFor(endpoint)
+}
 
-	// Wildcard match (e.g., "/admin/*" matches "/admin/users")
-	if strings.HasSuffix(configPath, "/*") {
-		prefix := strings.TrimSuffix(configPath, "/*")
-		return strings.HasPrefix(requestPath, prefix)
+// matchEndpoint returns the first endpoint policy that matches the request and sets the setting we're after
+func (prox *RateLimitingProxy) matchEndpoint(req *http.Request, sets func(config.EndpointPolicy) bool) (config.EndpointPolicy, bool) {
+	for _, endpoint := range prox.config.Endpoints {
+		if !sets(endpoint) || (endpoint.Method != "" && endpoint.Method != req.Method) {
+			continue
+		}
+		if prox.pathMatches(req.URL.Path, endpoint.Path) {
+			return endpoint, true
+		}
 	}
+	return config.EndpointPolicy{}, false
+}
 
-	return false
+func (prox *RateLimitingProxy) pathMatches(requestPath, configPath string) bool {
+	return config.PathMatches(requestPath, configPath) // Exact, or a wildcard like "/admin/*" - shared with config validation
 }
 
 func (prox *RateLimitingProxy) getJWTFromHeader(req *http.Request) (string, error) {
 	authHeader := req.Header.Get("Authorization")
 	if authHeader == "" {
-		return "", fmt.Errorf("missing required Authorization header")
+		return "", authFailure(authReasonMissingToken, fmt.Errorf("missing required Authorization header"))
 	}
 
 	// Check for "Bearer " prefix
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", fmt.Errorf("invalid Authorization header format")
+		return "", authFailure(authReasonMalformedToken, fmt.Errorf("invalid Authorization header format"))
 	}
 
 	// Extract token (remove "Bearer " prefix)
 	token := strings.TrimPrefix(authHeader, "Bearer ")
 	if token == "" {
-		return "", fmt.Errorf("missing required JWT")
+		return "", authFailure(authReasonMissingToken, fmt.Errorf("missing required JWT"))
 	}
 
 	return token, nil
@@ -387,7 +724,7 @@ func (prox *RateLimitingProxy) parseJWT(tokenString string) (*JWTClaims, error)
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse JWT: %w", err)
+		return nil, authFailure(jwtFailureReason(err), fmt.Errorf("failed to parse JWT: %w", err))
 	}
 
 	// Pull out the claims
@@ -395,64 +732,130 @@ func (prox *RateLimitingProxy) parseJWT(tokenString string) (*JWTClaims, error)
 		return claims, nil
 	}
 
-	return nil, fmt.Errorf("invalid JWT claims")
+	return nil, authFailure(authReasonInvalidToken, fmt.Errorf("invalid JWT claims"))
 }
 
-func (prox *RateLimitingProxy) validateJWT(req *http.Request) (int64, error) {
+// checkRevocation rejects tokens on the deny-list, by jti or by subject.
+// If the deny-list can't be read we fail closed, same as the limiter
+func (prox *RateLimitingProxy) checkRevocation(ctx context.Context, claims *JWTClaims) error {
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	revoked, err := prox.revocations.IsRevoked(ctx, claims.ID, claims.UserID, issuedAt)
+	if err != nil {
+		ErrorLogger.Printf("Revocation check failed - Subject: %s: %v", claims.UserID, err)
+		return authFailure(authReasonRevocationUnavailable, fmt.Errorf("unable to check token revocation: %w", err))
+	}
+	if revoked {
+		return authFailure(authReasonRevoked, fmt.Errorf("token has been revoked"))
+	}
+	return nil
+}
+
+func (prox *RateLimitingProxy) validateJWT(req *http.Request) (*JWTClaims, error) {
 	// Extract token from header
 	tokenString, err := prox.getJWTFromHeader(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	// Parse and validate token
 	claims, err := prox.parseJWT(tokenString)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	// Validate account ID is present
 	if claims.AccountID <= 0 {
-		return 0, fmt.Errorf("invalid account ID in JWT")
+		return nil, authFailure(authReasonMissingAccount, fmt.Errorf("invalid account ID in JWT"))
 	}
 
-	return claims.AccountID, nil
+	if err := prox.checkRevocation(req.Context(), claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
 }
 
-func (prox *RateLimitingProxy) validateAdminJWT(req *http.Request) (int64, error) {
+func (prox *RateLimitingProxy) validateAdminJWT(req *http.Request) (*JWTClaims, error) {
 	// Extract token from header
 	tokenString, err := prox.getJWTFromHeader(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	// Parse and validate token
 	claims, err := prox.parseJWT(tokenString)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	// Validate account ID is present
 	if claims.AccountID <= 0 {
-		return 0, fmt.Errorf("invalid account ID in JWT")
+		return nil, authFailure(authReasonMissingAccount, fmt.Errorf("invalid account ID in JWT"))
+	}
+
+	if err := prox.checkRevocation(req.Context(), claims); err != nil {
+		return nil, err
 	}
 
 	// Check admin role
 	if claims.Role != "admin" {
-		return 0, fmt.Errorf("insufficient privileges: admin role required")
+		return nil, authFailure(authReasonInsufficientRole, fmt.Errorf("insufficient privileges: admin role required"))
 	}
 
-	return claims.AccountID, nil
+	return claims, nil
+}
+
+// Why a token was turned away - returned to the client, so they can tell "get a new token" from "you can't do that"
+const (
+	authReasonMissingToken          = "missing_token"
+	authReasonMalformedToken        = "malformed_token"
+	authReasonBadSignature          = "bad_signature"
+	authReasonExpired               = "expired"
+	authReasonNotYetValid           = "not_yet_valid"
+	authReasonInvalidToken          = "invalid_token"
+	authReasonMissingAccount        = "missing_account"
+	authReasonRevoked               = "revoked"
+	authReasonRevocationUnavailable = "revocation_unavailable"
+	authReasonInsufficientRole      = "insufficient_role"
+)
+
+// authError carries the reason a token check failed
+type authError struct {
+	reason string
+	err    error
 }
 
-// setupGracefulShutdown handles SIGINT/SIGTERM for clean shutdown
-func setupGracefulShutdown() {
-	InfoLogger.Println("Setting up graceful shutdown...")
+func (authErr *authError) Error() string { return authErr.err.Error() }
+func (authErr *authError) Unwrap() error { return authErr.err }
 
+func authFailure(reason string, err error) error {
+	return &authError{reason: reason, err: err}
 }
 
-// sanitizeURL removes credentials from URLs for safe logging
-func sanitizeURL(url string) string {
-	// TODO: Remove username/password from URLs before logging
-	return url
+func authReasonFor(err error) string {
+	var authErr *authError
+	if errors.As(err, &authErr) {
+		return authErr.reason
+	}
+	return authReasonInvalidToken
+}
+
+// jwtFailureReason picks out why the JWT library rejected a token
+func jwtFailureReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return authReasonExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return authReasonNotYetValid
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return authReasonBadSignature
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return authReasonMalformedToken
+	default:
+		return authReasonInvalidToken
+	}
 }
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Just enough of a metrics registry to serve the Prometheus text format from /metrics,
+// without dragging in the whole client library
+
+type metricType string
+
+const (
+	counterType metricType = "counter"
+	gaugeType   metricType = "gauge"
+)
+
+// One metric family - a name, and a value per label combination
+type family struct {
+	name       string
+	help       string
+	kind       metricType
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64 // Rendered label set -> value
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*family)
+)
+
+func register(name, help string, kind metricType, labelNames []string) *family {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if existing, exists := registry[name]; exists {
+		return existing // Re-registering hands back the same metric, so it's safe to call from constructors
+	}
+	fam := &family{name: name, help: help, kind: kind, labelNames: labelNames, values: make(map[string]float64)}
+	registry[name] = fam
+	return fam
+}
+
+func (fam *family) labelKey(labelValues []string) string {
+	if len(labelValues) != len(fam.labelNames) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", fam.name, len(fam.labelNames), len(labelValues)))
+	}
+	if len(labelValues) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labelValues))
+	for i, val := range labelValues {
+		pairs[i] = fmt.Sprintf("%s=%s", fam.labelNames[i], strconv.Quote(val))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter only goes up
+type Counter struct{ fam *family }
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{fam: register(name, help, counterType, labelNames)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return // Counters don't go backwards
+	}
+	key := c.fam.labelKey(labelValues)
+	c.fam.mu.Lock()
+	c.fam.values[key] += delta
+	c.fam.mu.Unlock()
+}
+
+// Gauge is a value that's set
+type Gauge struct{ fam *family }
+
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{fam: register(name, help, gaugeType, labelNames)}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.fam.labelKey(labelValues)
+	g.fam.mu.Lock()
+	g.fam.values[key] = value
+	g.fam.mu.Unlock()
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler() http.HandlerFunc {
+	return func(wtr http.ResponseWriter, req *http.Request) {
+		wtr.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		wtr.Write([]byte(Render()))
+	}
+}
+
+// Render writes out every registered metric
+func Render() string {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMu.Unlock()
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		registryMu.Lock()
+		fam := registry[name]
+		registryMu.Unlock()
+
+		fam.mu.Lock()
+		keys := make([]string, 0, len(fam.values))
+		for key := range fam.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", fam.name, fam.help, fam.name, fam.kind)
+		for _, key := range keys {
+			fmt.Fprintf(&out, "%s%s %s\n", fam.name, key, formatValue(fam.values[key]))
+		}
+		fam.mu.Unlock()
+	}
+	return out.String()
+}
+
+func formatValue(val float64) string {
+	if math.IsInf(val, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"rate-limiter/config"
+	"rate-limiter/metrics"
+	"rate-limiter/redact"
+	"rate-limiter/types"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var backendRequests = metrics.NewCounter("ratelimiter_backend_requests_total", "Requests sent to each backend target", "backend")
+
+// Points each target gets on the consistent hash ring - enough that the accounts spread evenly
+const ringPointsPerTarget = 100
+
+// upstream is one backend target
+type upstream struct {
+	target   string
+	name     string              // target, credentials stripped - for logs and metrics
+	director func(*http.Request) // Points a request at this target
+	health   *healthChecker
+	breaker  *circuitBreaker
+	inFlight atomic.Int64
+}
+
+// backendPool spreads requests over the backend targets, skipping any that are marked down
+type backendPool struct {
+	upstreams []*upstream
+	policy    string
+	slowStart time.Duration
+	next      atomic.Uint64 // Round robin position
+	ring      []ringPoint   // Consistent hashing only - sorted by hash
+	budget    *retryBudget  // Shared by every route
+
+	checkInterval time.Duration // How soon a target that's down could be back
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream *upstream
+}
+
+// poolStatus is what /health reports - the backend as a whole, and each target
+type poolStatus struct {
+	Status        string         `json:"status"`  // healthy while any target is up
+	Backend       string         `json:"backend"` // up while any target is up, down once they all are
+	LoadBalancing string         `json:"load_balancing"`
+	Targets       []healthStatus `json:"targets"`
+}
+
+// newBackendPool builds the pool cfg describes. Targets that were in old (if any) are carried over with their
+// health history and in-flight counts - nothing is started until Start
+func newBackendPool(cfg *config.Config, old *backendPool) (*backendPool, error) {
+	pool := &backendPool{
+		policy:    cfg.BackendConfig.LoadBalancing,
+		slowStart: cfg.BackendConfig.SlowStart,
+		budget:    newRetryBudget(cfg.RetryBudget),
+
+		checkInterval: cfg.HealthCheckConfig.Interval,
+	}
+	if old != nil && old.budget.settings == cfg.RetryBudget {
+		pool.budget = old.budget // Retries made just before the reload still count
+	}
+	for _, target := range cfg.BackendConfig.Pool() {
+		if existing := old.find(target, cfg); existing != nil {
+			pool.upstreams = append(pool.upstreams, existing)
+			continue
+		}
+		targetURL, err := url.Parse(target.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backend URL %s: %v", redact.URL(target.URL), err)
+		}
+		name := redact.URL(target.URL)
+		pool.upstreams = append(pool.upstreams, &upstream{
+			target:   target.URL,
+			name:     name,
+			director: httputil.NewSingleHostReverseProxy(targetURL).Director,
+			health:   newHealthChecker(target.HealthcheckURL, name, cfg.HealthCheckConfig),
+			breaker:  newCircuitBreaker(name, cfg.CircuitBreaker),
+		})
+	}
+	if pool.policy == config.BalanceConsistentHash {
+		pool.buildRing()
+	}
+	return pool, nil
+}
+
+// find returns old's upstream for target, if it's checked and broken the same way - nil otherwise (or without an old pool)
+func (pool *backendPool) find(target config.BackendTarget, cfg *config.Config) *upstream {
+	if pool == nil {
+		return nil
+	}
+	for _, up := range pool.upstreams {
+		if up.target == target.URL && up.health.matches(target.HealthcheckURL, cfg.HealthCheckConfig) &&
+			up.breaker.settings == cfg.CircuitBreaker {
+			return up
+		}
+	}
+	return nil
+}
+
+// Start starts checking every target's health - carried over targets are already running
+func (pool *backendPool) Start() {
+	for _, up := range pool.upstreams {
+		up.health.Start()
+	}
+}
+
+// StopUnused stops checking the targets that aren't in the pool replacing this one
+func (pool *backendPool) StopUnused(replacement *backendPool) {
+	kept := make(map[*upstream]bool, len(replacement.upstreams))
+	for _, up := range replacement.upstreams {
+		kept[up] = true
+	}
+	for _, up := range pool.upstreams {
+		if !kept[up] {
+			up.health.Stop()
+		}
+	}
+}
+
+func (pool *backendPool) buildRing() {
+	for _, up := range pool.upstreams {
+		for i := 0; i < ringPointsPerTarget; i++ {
+			pool.ring = append(pool.ring, ringPoint{hash: hashKey(up.target + "#" + strconv.Itoa(i)), upstream: up})
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+}
+
+// Pick chooses the target for a request - nil if every target is marked down or has its circuit open
+func (pool *backendPool) Pick(limitReq *types.RateLimitRequest) *upstream {
+	switch pool.policy {
+	case config.BalanceLeastConnections:
+		return pool.leastConnections()
+	case config.BalanceConsistentHash:
+		return pool.consistentHash(limitReq)
+	default:
+		return pool.roundRobin()
+	}
+}
+
+// roundRobin takes the targets in turn. One that's slow starting only takes its turn some of the time
+func (pool *backendPool) roundRobin() *upstream {
+	var fallback *upstream
+	for range pool.upstreams {
+		// A skipped turn moves the rotation on, so it's spread over the rest rather than all going to the next in line
+		up := pool.upstreams[pool.next.Add(1)%uint64(len(pool.upstreams))]
+		share := up.share(pool.slowStart)
+		if share == 0 {
+			continue // Down
+		}
+		if share >= 1 || rand.Float64() < share {
+			return up
+		}
+		if fallback == nil {
+			fallback = up // Warming targets are still better than nothing
+		}
+	}
+	return fallback
+}
+
+// leastConnections picks the target with the fewest requests in flight, relative to its share
+func (pool *backendPool) leastConnections() *upstream {
+	start := pool.next.Add(1) // Ties go round robin, not always to the first target
+	var best *upstream
+	bestLoad := 0.0
+	for i := range pool.upstreams {
+		up := pool.upstreams[(start+uint64(i))%uint64(len(pool.upstreams))]
+		share := up.share(pool.slowStart)
+		if share == 0 {
+			continue
+		}
+		load := float64(up.inFlight.Load()+1) / share
+		if best == nil || load < bestLoad {
+			best, bestLoad = up, load
+		}
+	}
+	return best
+}
+
+// consistentHash sends each account to the same target every time, so the backend's caches stay warm. When a target
+// goes down only its accounts move. While it slow starts, its accounts come back a fraction at a time - always the
+// same ones, so they don't bounce between targets
+func (pool *backendPool) consistentHash(limitReq *types.RateLimitRequest) *upstream {
+	key := limitReq.Subject // The account ID - or the client IP prefix for anonymous traffic
+	if key == "" {
+		key = strconv.FormatInt(limitReq.AccountID, 10)
+	}
+	hash := hashKey(key)
+	keyShare := float64(hash%10000) / 10000
+
+	first := sort.Search(len(pool.ring), func(i int) bool { return pool.ring[i].hash >= hash })
+	var fallback *upstream
+	tried := make(map[*upstream]bool, len(pool.upstreams))
+	for i := 0; i < len(pool.ring) && len(tried) < len(pool.upstreams); i++ {
+		up := pool.ring[(first+i)%len(pool.ring)].upstream
+		if tried[up] {
+			continue
+		}
+		tried[up] = true
+		share := up.share(pool.slowStart)
+		if share == 0 {
+			continue
+		}
+		if keyShare < share {
+			return up
+		}
+		if fallback == nil {
+			fallback = up
+		}
+	}
+	return fallback
+}
+
+func hashKey(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	// FNV barely touches the high bits for keys that differ at the end (account 11, 12...) - mix them, or neighbouring
+	// accounts all land on the same stretch of the ring
+	hash := hasher.Sum64()
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// Ready is true while any target is up, with its circuit breaker letting requests through
+func (pool *backendPool) Ready() bool {
+	for _, up := range pool.upstreams {
+		if up.health.Ready() && up.breaker.State() != circuitOpen {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *backendPool) Status() poolStatus {
+	status := poolStatus{Status: "unhealthy", Backend: backendStateDown, LoadBalancing: pool.policy}
+	for _, up := range pool.upstreams {
+		target := up.health.Status()
+		target.InFlight = up.inFlight.Load()
+		target.Share = up.share(pool.slowStart)
+		target.Circuit = up.breaker.State()
+		status.Targets = append(status.Targets, target)
+
+		switch {
+		case target.Backend == backendStateUp && target.Circuit != circuitOpen:
+			status.Status, status.Backend = "healthy", backendStateUp
+		case target.Backend == backendStateUnknown && status.Backend == backendStateDown:
+			status.Backend = backendStateUnknown
+		}
+	}
+	return status
+}
+
+// RetryAfter is how soon some target might take requests again, when none will now - the next health check for
+// a target that's down, or when an open circuit breaker tries its target again
+func (pool *backendPool) RetryAfter() time.Duration {
+	retryAfter := time.Duration(0)
+	for _, up := range pool.upstreams {
+		wait := pool.checkInterval
+		if !up.health.Down() {
+			wait = up.breaker.RetryAfter()
+		}
+		if retryAfter == 0 || (wait > 0 && wait < retryAfter) {
+			retryAfter = wait
+		}
+	}
+	return max(retryAfter, time.Second)
+}
+
+// share is how much of its usual traffic a target should get now - none while it's down or its circuit is open
+func (up *upstream) share(slowStart time.Duration) float64 {
+	if !up.breaker.Available() {
+		return 0
+	}
+	return up.health.Share(slowStart)
+}
+
+// Forward counts a request to the target until done is called - least connections balances on it. Retries count again
+func (up *upstream) Forward() (done func()) {
+	backendRequests.Inc(up.name)
+	up.inFlight.Add(1)
+	return func() { up.inFlight.Add(-1) }
+}
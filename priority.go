@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"rate-limiter/config"
+	"strings"
+)
+
+// requestPriority picks the request's priority class: a trusted caller's header first (eg our frontend marking
+// checkout calls), then the token's claim, then the default. Unknown classes are ignored rather than rejected
+func (prox *RateLimitingProxy) requestPriority(req *http.Request, claimed string) string {
+	priorityConfig := prox.config.PriorityConfig
+
+	if priorityConfig.Header != "" {
+		if header := strings.ToLower(strings.TrimSpace(req.Header.Get(priorityConfig.Header))); header != "" {
+			if prox.isPriorityCaller(req) && config.IsKnownPriority(header) {
+				return header
+			}
+			InfoLogger.Printf("Ignoring %s: %s from %s", priorityConfig.Header, header, req.RemoteAddr)
+		}
+	}
+
+	if config.IsKnownPriority(claimed) {
+		return claimed
+	}
+	return priorityConfig.Default
+}
+
+// isPriorityCaller reports whether the (real) client is allowed to set its own priority
+func (prox *RateLimitingProxy) isPriorityCaller(req *http.Request) bool {
+	addr, err := prox.clientIPs.ClientAddr(req)
+	if err != nil {
+		return false
+	}
+	return prox.priorityCallers.IsTrusted(addr)
+}
+
+// applyPriority cuts a limit down to the share its priority class can use.
+// Every class shares one counter, so once lower classes hit their share only higher ones get through.
+// 0 (unlimited / limiter default) is left alone, and nothing is cut below 1
+func (prox *RateLimitingProxy) applyPriority(limit int64, priority string) int64 {
+	share := prox.config.PriorityConfig.ShareFor(priority)
+	if limit <= 0 || share >= 1 {
+		return limit
+	}
+	return max(int64(math.Floor(float64(limit)*share)), 1)
+}
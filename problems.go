@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"rate-limiter/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors are RFC 9457 problem details, for clients that ask for JSON. Everyone else still gets the plain text title,
+// so nothing that already matches on "Rate limit exceeded" breaks
+
+// Problem types - stable identifiers clients can switch on
+const (
+	problemTypeBase         = "urn:rate-limiter:problem:"
+	problemUnauthorized     = problemTypeBase + "unauthorized"
+	problemForbidden        = problemTypeBase + "forbidden"
+	problemRateLimited      = problemTypeBase + "rate-limited"
+	problemTooManyInFlight  = problemTypeBase + "too-many-in-flight"
+	problemBadGateway       = problemTypeBase + "bad-gateway"
+	problemBackendDown      = problemTypeBase + "backend-unavailable"
+	problemGatewayTimeout   = problemTypeBase + "gateway-timeout"
+	problemLimiterDown      = problemTypeBase + "rate-limiting-unavailable"
+	problemUnidentifiedUser = problemTypeBase + "unidentified-client"
+
+	// Admin endpoints
+	problemBadRequest       = problemTypeBase + "bad-request"
+	problemNotFound         = problemTypeBase + "not-found"
+	problemMethodNotAllowed = problemTypeBase + "method-not-allowed"
+	problemStoreDown        = problemTypeBase + "store-unavailable" // Redis, behind revocations, quotas or the adaptive multiplier
+)
+
+const problemContentType = "application/problem+json"
+
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"` // The request path
+
+	// Extensions
+	RequestID  string     `json:"request_id,omitempty"`
+	Reason     string     `json:"reason,omitempty"` // Auth failures only - see the authReason constants
+	Policy     string     `json:"policy,omitempty"` // Rate limits only - the limit that said no
+	Limit      *int64     `json:"limit,omitempty"`
+	Remaining  *int64     `json:"remaining,omitempty"`
+	Reset      *time.Time `json:"reset,omitempty"`
+	RetryAfter *int64     `json:"retry_after,omitempty"` // Seconds
+}
+
+func newProblem(status int, problemType, title, detail string) *problem {
+	return &problem{Type: problemType, Title: title, Status: status, Detail: detail}
+}
+
+// rateLimitProblem describes a 429 from the limit that tripped
+func rateLimitProblem(result *types.RateLimitResult) *problem {
+	prob := newProblem(http.StatusTooManyRequests, problemRateLimited, "Rate limit exceeded",
+		fmt.Sprintf("Rate limit %s exceeded", result.Policy))
+	prob.Policy = result.Policy
+	if result.Limit > 0 {
+		prob.Limit = &result.Limit
+		prob.Remaining = &result.Remaining
+		prob.Reset = &result.ResetTime
+	}
+	if result.RetryAfter >= 0 {
+		seconds := int64(result.RetryAfter.Seconds())
+		prob.RetryAfter = &seconds
+	}
+	return prob
+}
+
+// What we tell the client about each auth failure - the underlying error can carry internals, so it's only logged
+var authReasonDetails = map[string]string{
+	authReasonMissingToken:          "A bearer token is required",
+	authReasonMalformedToken:        "The bearer token is malformed",
+	authReasonBadSignature:          "The token signature is invalid",
+	authReasonExpired:               "The token has expired",
+	authReasonNotYetValid:           "The token is not valid yet",
+	authReasonInvalidToken:          "The token is invalid",
+	authReasonMissingAccount:        "The token has no account",
+	authReasonRevoked:               "The token has been revoked",
+	authReasonRevocationUnavailable: "Unable to check whether the token has been revoked",
+	authReasonInsufficientRole:      "The token does not grant access to this path",
+}
+
+// authProblem turns a failed token check into a 401 (or 403, when the token's fine but not allowed)
+func authProblem(err error) *problem {
+	reason := authReasonFor(err)
+	var prob *problem
+	if reason == authReasonInsufficientRole {
+		prob = newProblem(http.StatusForbidden, problemForbidden, "Forbidden", authReasonDetails[reason])
+	} else {
+		prob = newProblem(http.StatusUnauthorized, problemUnauthorized, "Unauthorized", authReasonDetails[reason])
+	}
+	prob.Reason = reason
+	return prob
+}
+
+// writeProblem answers with the problem - as problem+json if the client prefers JSON, plain text otherwise
+func writeProblem(wtr http.ResponseWriter, req *http.Request, prob *problem) {
+	prob.Instance = req.URL.Path
+	prob.RequestID = requestIDFrom(req)
+
+	if !prefersJSON(req.Header.Get("Accept")) {
+		http.Error(wtr, prob.Title, prob.Status)
+		return
+	}
+
+	body, err := json.Marshal(prob)
+	if err != nil {
+		ErrorLogger.Printf("Unable to encode problem response: %v", err)
+		http.Error(wtr, prob.Title, prob.Status)
+		return
+	}
+	wtr.Header().Set("Content-Type", problemContentType)
+	wtr.Header().Set("X-Content-Type-Options", "nosniff")
+	wtr.WriteHeader(prob.Status)
+	wtr.Write(body)
+}
+
+// prefersJSON reports whether the Accept header ranks a JSON type above plain text.
+// A bare */* (or no Accept at all) keeps plain text - that's what existing clients were built against
+func prefersJSON(accept string) bool {
+	jsonQ, textQ := -1.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qVal, exists := params["q"]; exists {
+			if parsed, err := strconv.ParseFloat(qVal, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case problemContentType, "application/json", "application/*":
+			jsonQ = max(jsonQ, q)
+		case "text/plain", "text/*":
+			textQ = max(textQ, q)
+		}
+	}
+	return jsonQ > 0 && jsonQ >= textQ
+}
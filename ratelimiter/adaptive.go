@@ -0,0 +1,319 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"rate-limiter/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	adaptive_multiplier_key string = "rladapt:multiplier"
+	adaptive_stats_proto    string = "rladapt:stats:%d" // Per interval, every instance adds its samples in
+	adaptive_lock_proto     string = "rladapt:lock:%d"  // Whoever takes this gets to adjust for the interval
+)
+
+var (
+	multiplierGauge = metrics.NewGauge("ratelimiter_adaptive_multiplier", "Multiplier currently applied to configured limits")
+	errorRateGauge  = metrics.NewGauge("ratelimiter_adaptive_backend_error_rate", "Backend error rate (5xx and transport errors) over the last adaptive interval")
+	latencyGauge    = metrics.NewGauge("ratelimiter_adaptive_backend_latency_seconds", "Mean backend latency over the last adaptive interval")
+)
+
+// AdaptiveSettings tune the AIMD loop
+type AdaptiveSettings struct {
+	Interval                 time.Duration `json:"interval"`                   // How often we adjust
+	ErrorRateThreshold       float64       `json:"error_rate_threshold"`       // Back off when 5xx + transport errors pass this share of responses
+	UnavailableRateThreshold float64       `json:"unavailable_rate_threshold"` // Back off when 503s alone pass this share - the backend is telling us it's overloaded
+	LatencyThreshold         time.Duration `json:"latency_threshold"`          // Back off when mean latency passes this
+	IncreaseStep             float64       `json:"increase_step"`              // Additive increase per healthy interval
+	DecreaseFactor           float64       `json:"decrease_factor"`            // Multiplicative decrease per unhealthy interval
+	MinMultiplier            float64       `json:"min_multiplier"`             // Never shrink limits further than this
+	MinSamples               int64         `json:"min_samples"`                // Fewer responses than this can't tell us the backend is unhealthy
+}
+
+// AdaptiveStats is what we saw of the backend over one interval, across every instance
+type AdaptiveStats struct {
+	Interval    int64         `json:"interval"`
+	Total       int64         `json:"total"`
+	Errors      int64         `json:"errors"`
+	Unavailable int64         `json:"unavailable"`
+	MeanLatency time.Duration `json:"mean_latency"`
+}
+
+// AdaptiveStatus is a point-in-time view for the admin API
+type AdaptiveStatus struct {
+	Multiplier float64          `json:"multiplier"`
+	LastStats  *AdaptiveStats   `json:"last_stats,omitempty"`
+	Settings   AdaptiveSettings `json:"settings"`
+}
+
+// AdaptiveController shrinks limits while the backend is struggling, and grows them back while it's healthy.
+// Additive-increase / multiplicative-decrease - the same loop TCP uses to back off a congested link.
+//
+// Every instance feeds its backend samples into Redis each interval, one instance adjusts the shared multiplier
+// from the combined numbers, and everybody picks it up. A nil controller is valid, and never adjusts anything
+type AdaptiveController struct {
+	client   *redis.Client
+	settings AdaptiveSettings
+
+	multiplier atomic.Uint64 // math.Float64bits - read on every request
+
+	// This interval's samples, not yet sent to Redis
+	total        atomic.Int64
+	errors       atomic.Int64
+	unavailable  atomic.Int64
+	latencySumMs atomic.Int64
+
+	mu        sync.Mutex
+	lastStats *AdaptiveStats
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewAdaptiveController(client *redis.Client, settings AdaptiveSettings) *AdaptiveController {
+	controller := &AdaptiveController{
+		client:   client,
+		settings: settings,
+		stop:     make(chan struct{}),
+	}
+	controller.setMultiplier(1.0)
+	return controller
+}
+
+// Start runs the adjustment loop in the background until Close
+func (controller *AdaptiveController) Start() {
+	if controller == nil {
+		return
+	}
+	controller.refresh()
+	go controller.run()
+}
+
+// Close stops the adjustment loop
+func (controller *AdaptiveController) Close() error {
+	if controller == nil {
+		return nil
+	}
+	controller.once.Do(func() { close(controller.stop) })
+	return nil
+}
+
+// Observe records one backend outcome. status 0 means we never got a response (connect error, timeout...)
+func (controller *AdaptiveController) Observe(status int, latency time.Duration) {
+	if controller == nil {
+		return
+	}
+	controller.total.Add(1)
+	controller.latencySumMs.Add(latency.Milliseconds())
+	if status == 0 || status >= 500 {
+		controller.errors.Add(1)
+	}
+	if status == 503 {
+		controller.unavailable.Add(1)
+	}
+}
+
+// Multiplier is the share of configured limits currently allowed, 0-1
+func (controller *AdaptiveController) Multiplier() float64 {
+	if controller == nil {
+		return 1.0
+	}
+	return math.Float64frombits(controller.multiplier.Load())
+}
+
+// Apply scales a configured limit by the current multiplier - never below 1, or nobody gets anything through
+func (controller *AdaptiveController) Apply(limit int64) int64 {
+	multiplier := controller.Multiplier()
+	if multiplier >= 1.0 || limit <= 0 {
+		return limit
+	}
+	return max(1, int64(math.Floor(float64(limit)*multiplier)))
+}
+
+// Status reports the multiplier and what it was last based on
+func (controller *AdaptiveController) Status() AdaptiveStatus {
+	controller.mu.Lock()
+	defer controller.mu.Unlock()
+	return AdaptiveStatus{
+		Multiplier: controller.Multiplier(),
+		LastStats:  controller.lastStats,
+		Settings:   controller.settings,
+	}
+}
+
+// Reset puts limits straight back to 100%, for every instance
+func (controller *AdaptiveController) Reset(ctx context.Context) error {
+	if err := controller.client.Set(ctx, adaptive_multiplier_key, 1.0, 0).Err(); err != nil {
+		return fmt.Errorf("unable to reset adaptive multiplier: %w", err)
+	}
+	controller.setMultiplier(1.0)
+	InfoLogger.Println("Adaptive multiplier reset to 1.0")
+	return nil
+}
+
+func (controller *AdaptiveController) setMultiplier(multiplier float64) {
+	controller.multiplier.Store(math.Float64bits(multiplier))
+	multiplierGauge.Set(multiplier)
+}
+
+// Ticks line up with wall-clock interval boundaries, so every instance agrees on which interval is which
+func (controller *AdaptiveController) run() {
+	interval := controller.settings.Interval
+	settle := interval / 10 // Give the other instances a moment to send in their samples
+
+	for {
+		next := time.Now().Truncate(interval).Add(interval)
+		select {
+		case <-controller.stop:
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		intervalId := next.UnixMilli()/interval.Milliseconds() - 1 // The interval that just ended - in ms, so 1.5s intervals get their own IDs
+		controller.flush(intervalId)
+
+		select {
+		case <-controller.stop:
+			return
+		case <-time.After(settle):
+		}
+
+		controller.adjust(intervalId)
+		controller.refresh()
+	}
+}
+
+// Send our samples for the interval to Redis
+func (controller *AdaptiveController) flush(intervalId int64) {
+	total := controller.total.Swap(0)
+	errs := controller.errors.Swap(0)
+	unavailable := controller.unavailable.Swap(0)
+	latencySum := controller.latencySumMs.Swap(0)
+	if total == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf(adaptive_stats_proto, intervalId)
+	pipe := controller.client.Pipeline()
+	pipe.HIncrBy(ctx, key, "total", total)
+	pipe.HIncrBy(ctx, key, "errors", errs)
+	pipe.HIncrBy(ctx, key, "unavailable", unavailable)
+	pipe.HIncrBy(ctx, key, "latency_ms", latencySum)
+	pipe.Expire(ctx, key, 3*controller.settings.Interval)
+	if _, err := pipe.Exec(ctx); err != nil {
+		ErrorLogger.Printf("Unable to send adaptive samples for interval %d: %v", intervalId, err)
+	}
+}
+
+// One instance per interval works out the new multiplier
+func (controller *AdaptiveController) adjust(intervalId int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	won, err := controller.client.SetNX(ctx, fmt.Sprintf(adaptive_lock_proto, intervalId), 1, 2*controller.settings.Interval).Result()
+	if err != nil {
+		ErrorLogger.Printf("Unable to take adaptive lock for interval %d: %v", intervalId, err)
+		return
+	}
+	if !won {
+		return // Someone else has it
+	}
+
+	stats, err := controller.readStats(ctx, intervalId)
+	if err != nil {
+		ErrorLogger.Printf("Unable to read adaptive samples for interval %d: %v", intervalId, err)
+		return
+	}
+
+	current, err := controller.client.Get(ctx, adaptive_multiplier_key).Float64()
+	if errors.Is(err, redis.Nil) {
+		current = 1.0
+	} else if err != nil {
+		ErrorLogger.Printf("Unable to read adaptive multiplier: %v", err)
+		return
+	}
+
+	next := controller.nextMultiplier(current, stats)
+	if err := controller.client.Set(ctx, adaptive_multiplier_key, next, 0).Err(); err != nil {
+		ErrorLogger.Printf("Unable to store adaptive multiplier: %v", err)
+		return
+	}
+	if next != current {
+		InfoLogger.Printf("Adaptive multiplier %.3f -> %.3f (responses: %d, errors: %d, 503s: %d, mean latency: %s)",
+			current, next, stats.Total, stats.Errors, stats.Unavailable, stats.MeanLatency)
+	}
+}
+
+func (controller *AdaptiveController) readStats(ctx context.Context, intervalId int64) (*AdaptiveStats, error) {
+	fields, err := controller.client.HGetAll(ctx, fmt.Sprintf(adaptive_stats_proto, intervalId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	field := func(name string) int64 {
+		val, _ := strconv.ParseInt(fields[name], 10, 64) // Missing is 0
+		return val
+	}
+
+	stats := &AdaptiveStats{
+		Interval:    intervalId,
+		Total:       field("total"),
+		Errors:      field("errors"),
+		Unavailable: field("unavailable"),
+	}
+	if stats.Total > 0 {
+		stats.MeanLatency = time.Duration(field("latency_ms")/stats.Total) * time.Millisecond
+	}
+
+	controller.mu.Lock()
+	controller.lastStats = stats
+	controller.mu.Unlock()
+	if stats.Total > 0 {
+		errorRateGauge.Set(float64(stats.Errors) / float64(stats.Total))
+		latencyGauge.Set(stats.MeanLatency.Seconds())
+	}
+	return stats, nil
+}
+
+// AIMD: back off hard when it hurts, creep back up when it doesn't
+func (controller *AdaptiveController) nextMultiplier(current float64, stats *AdaptiveStats) float64 {
+	settings := controller.settings
+	unhealthy := false
+	if stats.Total >= settings.MinSamples {
+		errorRate := float64(stats.Errors) / float64(stats.Total)
+		unavailableRate := float64(stats.Unavailable) / float64(stats.Total)
+		unhealthy = errorRate > settings.ErrorRateThreshold ||
+			unavailableRate > settings.UnavailableRateThreshold ||
+			stats.MeanLatency > settings.LatencyThreshold
+	}
+
+	if unhealthy {
+		return max(settings.MinMultiplier, current*settings.DecreaseFactor)
+	}
+	return min(1.0, current+settings.IncreaseStep)
+}
+
+// Pick up the shared multiplier
+func (controller *AdaptiveController) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	multiplier, err := controller.client.Get(ctx, adaptive_multiplier_key).Float64()
+	if errors.Is(err, redis.Nil) {
+		multiplier = 1.0
+	} else if err != nil {
+		ErrorLogger.Printf("Unable to read adaptive multiplier, keeping %.3f: %v", controller.Multiplier(), err)
+		return
+	}
+	controller.setMultiplier(multiplier)
+}
@@ -21,14 +21,7 @@ var (
 )
 
 const key_delimiter string = ":"
-const key_prototype string = "%s:%s:%d:%s:%d" // Key structure for consistency
-const (
-	idx_prefix          int = 0
-	idx_algorithm       int = 1
-	idx_accountId       int = 2
-	idx_path            int = 3
-	idx_bucketTimestamp int = 4
-)
+const key_prototype string = "%s:%s:%s:%s:%s:%d" // Key structure for consistency: prefix:algorithm:policy:subject:path:bucketTimestamp
 
 type BucketedSlidingWindowRateLimiter struct {
 	client            *redis.Client
@@ -40,17 +33,17 @@ type BucketedSlidingWindowRateLimiter struct {
 	keyPrefix         string
 }
 
-func NewBucketedSlidingWindowLimiter(redClient *redis.Client, windowSize time.Duration, defaultLimit int64) RateLimiter {
+func NewBucketedSlidingWindowLimiter(redClient *redis.Client, windowSize time.Duration, defaultLimit int64) (RateLimiter, error) {
 	// TODO - allow passing of better configs
 	bucketCount := 30
 	keyPrefix := "rlbuk" //'rate limiting bucket'
 
 	if bucketCount <= 0 {
-		ErrorLogger.Panic("Invalid bucketing configuration supplied - Window Size: %v, Bucket Count: %v", windowSize, bucketCount)
+		return nil, fmt.Errorf("invalid bucketing configuration - window size: %v, bucket count: %v", windowSize, bucketCount)
 	}
 	bucketWidth := windowSize / time.Duration(bucketCount)
 	if bucketWidth <= 0 {
-		ErrorLogger.Panic("Invalid bucketing configuration supplied - Window Size: %v, Bucket Count: %v, Bucket Width: %v", windowSize, bucketCount, bucketWidth)
+		return nil, fmt.Errorf("invalid bucketing configuration - window size: %v, bucket count: %v, bucket width: %v", windowSize, bucketCount, bucketWidth)
 	}
 
 	return &BucketedSlidingWindowRateLimiter{
@@ -61,88 +54,165 @@ func NewBucketedSlidingWindowLimiter(redClient *redis.Client, windowSize time.Du
 		DefaultlimitCount: defaultLimit,
 		algorithm:         "bucketed", // Used in key construction
 		keyPrefix:         keyPrefix,
-	}
+	}, nil
+}
 
+func (rateLimiter *BucketedSlidingWindowRateLimiter) getBucketKey(policy string, subject string, path string, bucketId int64) string {
+	return fmt.Sprintf(key_prototype, rateLimiter.keyPrefix, rateLimiter.algorithm, policy, subject, path, bucketId)
 }
 
-func (rateLimiter *BucketedSlidingWindowRateLimiter) getBucketKey(accountId int64, path string, bucketId int64) string {
-	return fmt.Sprintf(key_prototype, rateLimiter.keyPrefix, rateLimiter.algorithm, accountId, path, bucketId)
+// Everything we need to know about the window a request falls in
+type bucketWindow struct {
+	limit            int64
+	windowSize       time.Duration
+	bucketWidth      time.Duration
+	bucketSeconds    int64
+	now              time.Time
+	windowStart      time.Time
+	currentBucketId  int64
+	currentBucketKey string
+	bucketKeys       []string
 }
 
-// CheckLimit implements the RateLimiter interface
-func (rateLimiter *BucketedSlidingWindowRateLimiter) CheckLimit(ctx context.Context, accountID int64, path string) (*types.RateLimitResult, error) {
+// Resolve the per-request limit and window, falling back to the configured defaults
+func (rateLimiter *BucketedSlidingWindowRateLimiter) windowFor(req *types.RateLimitRequest) *bucketWindow {
+	limit := rateLimiter.DefaultlimitCount
+	if req.Limit > 0 {
+		limit = req.Limit
+	}
+
+	windowSize, bucketWidth := rateLimiter.windowSize, rateLimiter.bucketWidth
+	if req.Period > 0 && req.Period != windowSize {
+		windowSize = req.Period
+		bucketWidth = windowSize / time.Duration(rateLimiter.bucketCount)
+	}
+	bucketWidth = bucketWidth.Truncate(time.Second) // Bucket IDs are whole seconds - anything finer can't be keyed
+	if bucketWidth < time.Second {
+		bucketWidth = time.Second
+	}
+	bucketSeconds := int64(bucketWidth.Seconds())
+
 	// Find the bucket - integer division
 	now := time.Now() // Request incoming time
-	currentBucketId := now.Unix() / int64(rateLimiter.bucketWidth.Seconds())
+	currentBucketId := now.Unix() / bucketSeconds
 
 	// get window boundaries
-	windowStart := now.Add(-1 * rateLimiter.windowSize) //  subtract window from now
-	windowStartId := windowStart.Unix() / int64(rateLimiter.bucketWidth.Seconds())
+	windowStart := now.Add(-1 * windowSize) //  subtract window from now
+	windowStartId := windowStart.Unix() / bucketSeconds
+
+	return &bucketWindow{
+		limit:            limit,
+		windowSize:       windowSize,
+		bucketWidth:      bucketWidth,
+		bucketSeconds:    bucketSeconds,
+		now:              now,
+		windowStart:      windowStart,
+		currentBucketId:  currentBucketId,
+		currentBucketKey: rateLimiter.getBucketKey(req.Policy, req.Subject, req.RequestPath, currentBucketId),
+		bucketKeys:       rateLimiter.getBucketsInWindow(req.Policy, req.Subject, req.RequestPath, windowStartId, currentBucketId),
+	}
+}
+
+// CheckLimit implements the RateLimiter interface
+func (rateLimiter *BucketedSlidingWindowRateLimiter) CheckLimit(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error) {
+	window := rateLimiter.windowFor(req)
+
+	// increment the current bucket - do this *first*, then separately re-load the count to catch racing requests
+	if err := rateLimiter.incrementBucket(ctx, req, window); err != nil {
+		return nil, err
+	}
 
-	currentBucketKey := rateLimiter.getBucketKey(accountID, path, currentBucketId)
+	totalCount, err := rateLimiter.countWindow(ctx, req, window)
+	if err != nil {
+		return nil, err
+	}
+	return rateLimiter.buildResult(req, window, totalCount), nil
+}
+
+// Peek implements the RateLimiter interface - counts the window as if this request was already in it
+func (rateLimiter *BucketedSlidingWindowRateLimiter) Peek(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error) {
+	window := rateLimiter.windowFor(req)
+
+	totalCount, err := rateLimiter.countWindow(ctx, req, window)
+	if err != nil {
+		return nil, err
+	}
+	return rateLimiter.buildResult(req, window, totalCount+req.Units()), nil
+}
 
-	bucketKeys := rateLimiter.getBucketsInWindow(accountID, path, windowStartId, currentBucketId)
+// Consume implements the RateLimiter interface
+func (rateLimiter *BucketedSlidingWindowRateLimiter) Consume(ctx context.Context, req *types.RateLimitRequest) error {
+	return rateLimiter.incrementBucket(ctx, req, rateLimiter.windowFor(req))
+}
 
+func (rateLimiter *BucketedSlidingWindowRateLimiter) incrementBucket(ctx context.Context, req *types.RateLimitRequest, window *bucketWindow) error {
 	incrPipe := rateLimiter.client.Pipeline() // Make this atomic
 
-	incrCmd := incrPipe.Incr(ctx, currentBucketKey) // increment the current bucket - do this *first*, then separately re-load the count to catch racing requests
+	incrCmd := incrPipe.IncrBy(ctx, window.currentBucketKey, req.Units())
 
 	_, err := incrPipe.Exec(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to check rate limits for account %d, key %s: %v", accountID, currentBucketKey, err)
+		return fmt.Errorf("Unable to check rate limits for %s, key %s: %v", req.Subject, window.currentBucketKey, err)
 	}
 
-	if incrCmd.Val() == 1 {
+	if incrCmd.Val() == req.Units() {
 		// This is a new bucket - set expiry
 		// There's a very small chance for racing expirys here, but it doesn't make a functional difference in outcome
 
-		expiryTime := rateLimiter.windowSize + rateLimiter.bucketWidth // At least one bucket wider than window width
-		err := rateLimiter.client.Expire(ctx, currentBucketKey, expiryTime).Err()
+		expiryTime := window.windowSize + window.bucketWidth // At least one bucket wider than window width
+		err := rateLimiter.client.Expire(ctx, window.currentBucketKey, expiryTime).Err()
 		if err != nil {
-			return nil, fmt.Errorf("Unable to set bucket expiration time for bucket %s: %v", currentBucketKey, err)
+			return fmt.Errorf("Unable to set bucket expiration time for bucket %s: %v", window.currentBucketKey, err)
 		}
 	}
+	return nil
+}
 
-	// Now get the sliding window count
+// Now get the sliding window count
+func (rateLimiter *BucketedSlidingWindowRateLimiter) countWindow(ctx context.Context, req *types.RateLimitRequest, window *bucketWindow) (int64, error) {
 	countPipe := rateLimiter.client.Pipeline() // Make this atomic
 
 	var getCountCmds []*redis.StringCmd
-	for _, bucketKey := range bucketKeys {
+	for _, bucketKey := range window.bucketKeys {
 		cmd := countPipe.Get(ctx, bucketKey)
 		getCountCmds = append(getCountCmds, cmd)
 	}
 
 	// Execute the commands to load bucketCmds with results
-	_, err = countPipe.Exec(ctx)
+	_, err := countPipe.Exec(ctx)
 	if err != nil && !errors.Is(err, redis.Nil) {
-		return nil, fmt.Errorf("Unable to read buckets for AccountID: %d, Path: %s - %w", accountID, path, err)
+		return 0, fmt.Errorf("Unable to read buckets for %s, Path: %s - %w", req.Subject, req.RequestPath, err)
 	}
 
-	totalCount := rateLimiter.calculateSlidingWindowCount(bucketKeys, getCountCmds, windowStart)
-	resetTime := time.Unix(currentBucketId, 0).Add(rateLimiter.bucketWidth) // End of current bucket
-	remainingInWindowCount := rateLimiter.DefaultlimitCount - totalCount    // This *can* be negative, since checking increments the counter. This punishes spammers who don't back off
-	retryAfter := resetTime.Sub(now)
+	return rateLimiter.calculateSlidingWindowCount(window.bucketKeys, getCountCmds, window.windowStart, window.bucketWidth), nil
+}
+
+func (rateLimiter *BucketedSlidingWindowRateLimiter) buildResult(req *types.RateLimitRequest, window *bucketWindow, totalCount int64) *types.RateLimitResult {
+	resetTime := time.Unix((window.currentBucketId+1)*window.bucketSeconds, 0) // End of current bucket
+	remainingInWindowCount := window.limit - totalCount                        // This *can* be negative, since checking increments the counter. This punishes spammers who don't back off
+	retryAfter := resetTime.Sub(window.now)
 	allowed := true
-	if totalCount >= rateLimiter.DefaultlimitCount { // TODO - need to load account-specific limit from Redis
-		InfoLogger.Printf("Limited request for AccountID: %d, Path: %s", accountID, path)
+	if totalCount >= window.limit {
+		InfoLogger.Printf("Limited request for %s, Path: %s, Policy: %s", req.Subject, req.RequestPath, req.Policy)
 		allowed = false
 	}
 	return &types.RateLimitResult{
 		Allowed:    allowed,
-		Limit:      rateLimiter.DefaultlimitCount,
+		Limit:      window.limit,
 		Remaining:  remainingInWindowCount,
 		ResetTime:  resetTime,
 		RetryAfter: retryAfter,
-	}, nil
-
+		Policy:     req.Policy,
+		Window:     window.windowSize,
+	}
 }
 
 // Iterate all the buckets between start and now, build keys for each, return []string
-func (rateLimiter *BucketedSlidingWindowRateLimiter) getBucketsInWindow(accountId int64, path string, windowStartId, windowEndId int64) []string {
+func (rateLimiter *BucketedSlidingWindowRateLimiter) getBucketsInWindow(policy string, subject string, path string, windowStartId, windowEndId int64) []string {
 	var bucketKeys []string
 
 	for bucketId := windowStartId; bucketId <= windowEndId; bucketId++ {
-		bucketKey := rateLimiter.getBucketKey(accountId, path, bucketId)
+		bucketKey := rateLimiter.getBucketKey(policy, subject, path, bucketId)
 		bucketKeys = append(bucketKeys, bucketKey)
 	}
 	return bucketKeys
@@ -159,6 +229,7 @@ func (rateLimiter *BucketedSlidingWindowRateLimiter) calculateSlidingWindowCount
 	bucketKeys []string,
 	bucketCmds []*redis.StringCmd,
 	windowStart time.Time,
+	bucketWidth time.Duration,
 ) int64 {
 	// We're assuming that requests are distributed evenly across a single bucket.
 	// If, eg, there are 5 buckets covering 5 minutes, each bucket holds a 1-minute slice
@@ -187,15 +258,15 @@ func (rateLimiter *BucketedSlidingWindowRateLimiter) calculateSlidingWindowCount
 		}
 
 		keyParts := strings.Split(bucketKey, key_delimiter)
-		bucketIdKey := keyParts[idx_bucketTimestamp] // Time is the last field in the key
+		bucketIdKey := keyParts[len(keyParts)-1] // Time is the last field in the key - paths and IPv6 subjects can contain the delimiter, so count from the end
 		bucketIdInt, err := strconv.ParseInt(bucketIdKey, 10, 64)
 		if err != nil {
 			// Log an error and move next - don't get stuck on invalid data
 			ErrorLogger.Printf("Invalid timestamp key in Bucket %v: %v", bucketKey, err)
 			continue
 		}
-		bucketStartTime := time.Unix(bucketIdInt*int64(rateLimiter.bucketWidth.Seconds()), 0)
-		bucketLatestTime := bucketStartTime.Add(rateLimiter.bucketWidth)
+		bucketStartTime := time.Unix(bucketIdInt*int64(bucketWidth.Seconds()), 0)
+		bucketLatestTime := bucketStartTime.Add(bucketWidth)
 
 		if bucketLatestTime.Before(windowStart.Add(5 * time.Millisecond)) {
 			// This means we somehow pulled a bucket that's outside our window entirely - ignore it, but log it.
@@ -210,8 +281,8 @@ func (rateLimiter *BucketedSlidingWindowRateLimiter) calculateSlidingWindowCount
 
 		if bucketStartTime.Before(windowStart) { // we're glossing over the latest bucket - it should always count 100%, even if it's not completed
 			// This bucket partially overlaps our window
-			overlapDuration := bucketLatestTime.Sub(windowStart)                                            // Difference between most recent bucket edge, and earliest window time
-			overlapFactor = float64(overlapDuration.Seconds()) / float64(rateLimiter.bucketWidth.Seconds()) // Get a pct as seconds to adjust the bucket counter by
+			overlapDuration := bucketLatestTime.Sub(windowStart)                                // Difference between most recent bucket edge, and earliest window time
+			overlapFactor = float64(overlapDuration.Seconds()) / float64(bucketWidth.Seconds()) // Get a pct as seconds to adjust the bucket counter by
 		}
 
 		totalCount += float64(bucketCount) * overlapFactor
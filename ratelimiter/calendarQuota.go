@@ -0,0 +1,242 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rate-limiter/types"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Calendar windows for quotas
+const (
+	CalendarDay   = "day"
+	CalendarMonth = "month"
+)
+
+const quota_key_prototype string = "%s:%s:%s:%s:%s:%s" // prefix:algorithm:policy:subject:path:period
+
+// Counters are kept well past their window, so last month's consumption can still be invoiced
+const quota_retention time.Duration = 400 * 24 * time.Hour
+
+// CalendarQuotaLimiter counts requests in calendar-aligned windows - midnight to midnight, or first of the month to
+// first of the month - in the customer's timezone. Unlike the sliding windows, counters survive their window
+type CalendarQuotaLimiter struct {
+	client            *redis.Client
+	DefaultlimitCount int64
+	algorithm         string
+	keyPrefix         string
+
+	locations sync.Map // timezone name -> *time.Location, LoadLocation reads tzdata every time
+}
+
+func NewCalendarQuotaLimiter(redClient *redis.Client, windowSize time.Duration, defaultLimit int64) (RateLimiter, error) {
+	// Window size doesn't apply - the calendar decides
+	return &CalendarQuotaLimiter{
+		client:            redClient,
+		DefaultlimitCount: defaultLimit,
+		algorithm:         "quota", // Used in key construction
+		keyPrefix:         "rlquota",
+	}, nil
+}
+
+// QuotaUsage is one counter - consumption for a policy/path in one calendar period
+type QuotaUsage struct {
+	Policy string `json:"policy"`
+	Path   string `json:"path"`
+	Period string `json:"period"` // 2006-01-02 for daily quotas, 2006-01 for monthly
+	Count  int64  `json:"count"`
+}
+
+// The calendar period a request falls in
+type quotaPeriod struct {
+	id    string
+	start time.Time
+	reset time.Time // Exact instant the next period starts
+}
+
+func (quota *CalendarQuotaLimiter) location(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := quota.locations.Load(timezone); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %s: %w", timezone, err)
+	}
+	quota.locations.Store(timezone, loc)
+	return loc, nil
+}
+
+// CurrentPeriod works out the calendar window containing now
+func CurrentPeriod(calendar string, loc *time.Location, now time.Time) (string, time.Time, time.Time, error) {
+	local := now.In(loc)
+	switch calendar {
+	case CalendarDay, "":
+		start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		return start.Format("2006-01-02"), start, start.AddDate(0, 0, 1), nil
+	case CalendarMonth:
+		start := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+		return start.Format("2006-01"), start, start.AddDate(0, 1, 0), nil
+	default:
+		return "", time.Time{}, time.Time{}, fmt.Errorf("unknown quota calendar %s", calendar)
+	}
+}
+
+func (quota *CalendarQuotaLimiter) periodFor(req *types.RateLimitRequest) (*quotaPeriod, error) {
+	loc, err := quota.location(req.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	id, start, reset, err := CurrentPeriod(req.Calendar, loc, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &quotaPeriod{id: id, start: start, reset: reset}, nil
+}
+
+func (quota *CalendarQuotaLimiter) getKey(req *types.RateLimitRequest, period *quotaPeriod) string {
+	return fmt.Sprintf(quota_key_prototype, quota.keyPrefix, quota.algorithm, req.Policy, req.Subject, req.RequestPath, period.id)
+}
+
+func (quota *CalendarQuotaLimiter) limitFor(req *types.RateLimitRequest) int64 {
+	if req.Limit > 0 {
+		return req.Limit
+	}
+	return quota.DefaultlimitCount
+}
+
+// CheckLimit implements the RateLimiter interface
+func (quota *CalendarQuotaLimiter) CheckLimit(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error) {
+	period, err := quota.periodFor(req)
+	if err != nil {
+		return nil, err
+	}
+	count, err := quota.increment(ctx, quota.getKey(req, period), period, req.Units())
+	if err != nil {
+		return nil, err
+	}
+	return quota.buildResult(req, period, count), nil
+}
+
+// Peek implements the RateLimiter interface
+func (quota *CalendarQuotaLimiter) Peek(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error) {
+	period, err := quota.periodFor(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := quota.getKey(req, period)
+	count, err := quota.client.Get(ctx, key).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("Unable to read quota %s: %w", key, err)
+	}
+	return quota.buildResult(req, period, count+req.Units()), nil
+}
+
+// Consume implements the RateLimiter interface
+func (quota *CalendarQuotaLimiter) Consume(ctx context.Context, req *types.RateLimitRequest) error {
+	period, err := quota.periodFor(req)
+	if err != nil {
+		return err
+	}
+	_, err = quota.increment(ctx, quota.getKey(req, period), period, req.Units())
+	return err
+}
+
+func (quota *CalendarQuotaLimiter) increment(ctx context.Context, key string, period *quotaPeriod, units int64) (int64, error) {
+	pipe := quota.client.Pipeline()
+	incrCmd := pipe.IncrBy(ctx, key, units)
+	// Re-setting the expiry every time is cheaper than a round trip to check it - it's the same instant anyway
+	pipe.ExpireAt(ctx, key, period.reset.Add(quota_retention))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("Unable to count quota %s: %w", key, err)
+	}
+	return incrCmd.Val(), nil
+}
+
+// Quotas are exact - a 50k/day quota allows exactly 50k units
+func (quota *CalendarQuotaLimiter) buildResult(req *types.RateLimitRequest, period *quotaPeriod, count int64) *types.RateLimitResult {
+	limit := quota.limitFor(req)
+	allowed := count <= limit
+	if !allowed {
+		InfoLogger.Printf("Quota exhausted for %s, Path: %s, Policy: %s, Period: %s", req.Subject, req.RequestPath, req.Policy, period.id)
+	}
+	return &types.RateLimitResult{
+		Allowed:    allowed,
+		Limit:      limit,
+		Remaining:  limit - count,
+		ResetTime:  period.reset,
+		RetryAfter: time.Until(period.reset),
+		Policy:     req.Policy,
+		Window:     period.reset.Sub(period.start), // Months (and DST days) vary
+	}
+}
+
+// Usage reads back consumption for a subject, for invoicing.
+// periodPrefix narrows it down - "2024-06" matches the June monthly counter and every June daily counter
+func (quota *CalendarQuotaLimiter) Usage(ctx context.Context, subject string, periodPrefix string) ([]QuotaUsage, error) {
+	keyStart := fmt.Sprintf("%s:%s:", quota.keyPrefix, quota.algorithm)
+	pattern := keyStart + "*:" + subject + ":*"
+
+	var keys []string
+	iter := quota.client.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to scan quotas for %s: %w", subject, err)
+	}
+
+	var usage []QuotaUsage
+	var countCmds []*redis.StringCmd
+	pipe := quota.client.Pipeline()
+	for _, key := range keys {
+		// Policy names are colon-free (config validation sees to it), but paths aren't - so peel the period off the end and the policy off the front
+		rest := strings.TrimPrefix(key, keyStart)
+		policy, rest, _ := strings.Cut(rest, key_delimiter)
+		rest, found := strings.CutPrefix(rest, subject+key_delimiter)
+		if !found {
+			continue // Pattern matched a longer subject
+		}
+		split := strings.LastIndex(rest, key_delimiter)
+		if split < 0 {
+			continue
+		}
+		path, period := rest[:split], rest[split+1:]
+		if !strings.HasPrefix(period, periodPrefix) {
+			continue
+		}
+		usage = append(usage, QuotaUsage{Policy: policy, Path: path, Period: period})
+		countCmds = append(countCmds, pipe.Get(ctx, key))
+	}
+	if len(countCmds) == 0 {
+		return usage, nil
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("Unable to read quotas for %s: %w", subject, err)
+	}
+	for i, cmd := range countCmds {
+		count, err := strconv.ParseInt(cmd.Val(), 10, 64)
+		if err != nil && cmd.Err() == nil {
+			ErrorLogger.Printf("Non-parsable quota counter for %s - %v: %v", subject, cmd.Val(), err)
+		}
+		usage[i].Count = count
+	}
+	return usage, nil
+}
+
+// Close gracefully shuts down the rate limiter
+func (quota *CalendarQuotaLimiter) Close() error {
+	// This stores nothing local
+	// So No-Op.
+	return nil
+}
@@ -0,0 +1,121 @@
+package ratelimiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const concurrency_key_prototype string = "%s:%s:%s" // prefix:subject:path
+
+// Drop expired leases, then take a slot if one is free - all in one go, or two instances can both take the last slot
+//
+//	KEYS[1] lease set, ARGV: now (ms), lease expiry (ms), lease ID, max in flight, set TTL (ms)
+var acquireScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// ConcurrencyLimiter caps in-flight requests, rather than requests per window.
+//
+// Each in-flight request holds a lease in a Redis sorted set, scored by when it expires. Leases are renewed while the
+// request is running, so a crashed instance can only hold slots for one lease TTL
+type ConcurrencyLimiter struct {
+	client    *redis.Client
+	leaseTTL  time.Duration
+	keyPrefix string
+}
+
+func NewConcurrencyLimiter(redClient *redis.Client, leaseTTL time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		client:    redClient,
+		leaseTTL:  leaseTTL,
+		keyPrefix: "rlconc", // 'rate limiting concurrency'
+	}
+}
+
+// Lease is one held slot. It renews itself until released
+type Lease struct {
+	limiter *ConcurrencyLimiter
+	key     string
+	id      string
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// Acquire takes a slot for subject/path if fewer than maxInFlight are held. Returns nil (and no error) if it's full
+func (limiter *ConcurrencyLimiter) Acquire(ctx context.Context, subject, path string, maxInFlight int64) (*Lease, error) {
+	key := fmt.Sprintf(concurrency_key_prototype, limiter.keyPrefix, subject, path)
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	acquired, err := acquireScript.Run(ctx, limiter.client, []string{key},
+		now.UnixMilli(), now.Add(limiter.leaseTTL).UnixMilli(), id, maxInFlight, limiter.leaseTTL.Milliseconds()).Int()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to acquire concurrency lease for %s, Path: %s: %w", subject, path, err)
+	}
+	if acquired != 1 {
+		InfoLogger.Printf("Concurrency limit %d reached for %s, Path: %s", maxInFlight, subject, path)
+		return nil, nil
+	}
+
+	lease := &Lease{limiter: limiter, key: key, id: id, stop: make(chan struct{})}
+	go lease.keepAlive()
+	return lease, nil
+}
+
+// Renew well before expiry - a couple of missed renewals shouldn't lose the slot
+func (lease *Lease) keepAlive() {
+	ticker := time.NewTicker(lease.limiter.leaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), lease.limiter.leaseTTL/3)
+			expiry := time.Now().Add(lease.limiter.leaseTTL).UnixMilli()
+			pipe := lease.limiter.client.Pipeline()
+			pipe.ZAddXX(ctx, lease.key, redis.Z{Score: float64(expiry), Member: lease.id})
+			pipe.PExpire(ctx, lease.key, lease.limiter.leaseTTL)
+			if _, err := pipe.Exec(ctx); err != nil {
+				ErrorLogger.Printf("Unable to renew concurrency lease %s: %v", lease.key, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Release gives the slot back. Safe to call more than once
+func (lease *Lease) Release() {
+	lease.once.Do(func() {
+		close(lease.stop)
+		// Not the request context - it's usually done (or cancelled) by the time we get here
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := lease.limiter.client.ZRem(ctx, lease.key, lease.id).Err(); err != nil {
+			ErrorLogger.Printf("Unable to release concurrency lease %s, it will expire on its own: %v", lease.key, err)
+		}
+	})
+}
+
+func newLeaseID() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("unable to generate lease ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -2,6 +2,7 @@ package ratelimiter
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -14,13 +15,15 @@ const ( // Play a sad kazoo 'my heart will go on' for the enums here
 	Permissive Algorithm = "allow_all"
 	// ContinuousSlidingWindow Algorithm = "continuous_sliding_window" // True continuous sliding window - no bucketing (Higher memory pressure)
 	BucketedSlidingWindow Algorithm = "bucketed_sliding_window" // Less memory pressure: 1-minute buckets (No less than 1-minute fidelity though)
+	CalendarQuota         Algorithm = "calendar_quota"          // Billing-style quotas - reset at midnight / first of the month, in the customer's timezone
 )
 
-type Constructor func(client *redis.Client, windowSize time.Duration, defaultLimit int64) RateLimiter
+type Constructor func(client *redis.Client, windowSize time.Duration, defaultLimit int64) (RateLimiter, error)
 
 var algorithmConstructors = map[Algorithm]Constructor{
 	Permissive:            NewPermissiveRateLimiter,
 	BucketedSlidingWindow: NewBucketedSlidingWindowLimiter,
+	CalendarQuota:         NewCalendarQuotaLimiter,
 	// TODO - MOAR.
 }
 
@@ -30,5 +33,21 @@ func NewRateLimiter(alg Algorithm, client *redis.Client, windowSize time.Duratio
 		return nil, fmt.Errorf("unknown rate-limiting algorithm %s", alg)
 	}
 
-	return constructor(client, windowSize, defaultLimit), nil
+	return constructor(client, windowSize, defaultLimit)
+}
+
+// Algorithms lists every algorithm we have an implementation for, by name
+func Algorithms() []Algorithm {
+	algorithms := make([]Algorithm, 0, len(algorithmConstructors))
+	for alg := range algorithmConstructors {
+		algorithms = append(algorithms, alg)
+	}
+	sort.Slice(algorithms, func(i, j int) bool { return algorithms[i] < algorithms[j] })
+	return algorithms
+}
+
+// IsKnownAlgorithm reports whether we have an implementation for alg
+func IsKnownAlgorithm(alg Algorithm) bool {
+	_, exists := algorithmConstructors[alg]
+	return exists
 }
@@ -7,10 +7,17 @@ import (
 
 type RateLimiter interface {
 	// Interface all rate-limiter algorithms should conform to
-	//	AccountID: Associate limit w. acctid, unique
-	//  Path: Path targeted on back-end by request
+	//	Subject: Who the limit is associated with - acctid, or client IP for anonymous callers, unique
+	//  RequestPath: Path targeted on back-end by request
+	//  Limit/Period: Over-ride the limiter defaults, when non-zero
 	//  returns LimitResult: decision, or err if unable to process
-	CheckLimit(ctx context.Context, accountId int64, path string) (*types.RateLimitResult, error)
+	CheckLimit(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error)
+
+	// Two-phase version of CheckLimit, for when several limits have to agree before any of them counts the request
+	//  Peek: decision as if the request were counted, without counting it
+	//  Consume: count the request
+	Peek(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error)
+	Consume(ctx context.Context, req *types.RateLimitRequest) error
 
 	// Graceful shutdown handler
 	// This needs to close DB connection handles, flush pending reqs, etc
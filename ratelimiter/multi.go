@@ -0,0 +1,125 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"rate-limiter/types"
+)
+
+// LimitCheck pairs one limit with the limiter that evaluates it
+type LimitCheck struct {
+	Limiter RateLimiter
+	Request *types.RateLimitRequest
+	Shadow  bool // Evaluated and counted as usual, but never denies - reported in the result's ShadowDenied instead
+}
+
+// CheckLimits evaluates several limits for one request - eg 10/second AND 1000/hour AND a per-account global limit.
+//
+// The request is denied if any (enforced) limit trips. Every limit is peeked before any is counted, so a rejected request
+// doesn't eat into the limits that would have let it through - only the tripped limits count it (same as CheckLimit,
+// this keeps punishing spammers who don't back off).
+// Peek-then-consume isn't atomic across limits: racing requests can overshoot by a few, which we accept.
+func CheckLimits(ctx context.Context, checks []LimitCheck) (*types.RateLimitResult, error) {
+	results, err := peekAll(ctx, checks)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := true
+	for i, result := range results {
+		allowed = allowed && (result.Allowed || checks[i].Shadow)
+	}
+
+	for i, check := range checks {
+		if allowed || !results[i].Allowed {
+			if err := check.Limiter.Consume(ctx, check.Request); err != nil {
+				return nil, fmt.Errorf("unable to count limit %s: %w", check.Request.Policy, err)
+			}
+		}
+	}
+
+	return combineChecks(checks, results), nil
+}
+
+// PeekLimits evaluates several limits without counting the request against any of them
+func PeekLimits(ctx context.Context, checks []LimitCheck) (*types.RateLimitResult, error) {
+	results, err := peekAll(ctx, checks)
+	if err != nil {
+		return nil, err
+	}
+	return combineChecks(checks, results), nil
+}
+
+// combineChecks combines the enforced limits' results, and lists the shadow limits that would have denied the request
+func combineChecks(checks []LimitCheck, results []*types.RateLimitResult) *types.RateLimitResult {
+	enforced := make([]*types.RateLimitResult, 0, len(results))
+	var shadowDenied []string
+	for i, result := range results {
+		if !checks[i].Shadow {
+			enforced = append(enforced, result)
+		} else if !result.Allowed {
+			shadowDenied = append(shadowDenied, result.Policy)
+		}
+	}
+
+	combined := CombineResults(enforced)
+	combined.ShadowDenied = shadowDenied
+	combined.Policies = enforced
+	return combined
+}
+
+func peekAll(ctx context.Context, checks []LimitCheck) ([]*types.RateLimitResult, error) {
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("no limits to check")
+	}
+
+	results := make([]*types.RateLimitResult, len(checks))
+	for i, check := range checks {
+		result, err := check.Limiter.Peek(ctx, check.Request)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check limit %s: %w", check.Request.Policy, err)
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// CombineResults folds several limit results into one: denied if any denied, the most restrictive remaining count
+// (and that limit's cap), and the longest wait. Unlimited results (Limit <= 0) only count towards the decision
+func CombineResults(results []*types.RateLimitResult) *types.RateLimitResult {
+	combined := &types.RateLimitResult{
+		Allowed:    true,
+		Limit:      -1,
+		Remaining:  -1,
+		RetryAfter: -1,
+	}
+
+	for _, result := range results {
+		if !result.Allowed {
+			combined.Allowed = false
+		}
+		if result.Limit > 0 && (combined.Limit <= 0 || result.Remaining < combined.Remaining) {
+			combined.Limit = result.Limit
+			combined.Remaining = result.Remaining
+			combined.Policy = result.Policy
+		}
+	}
+
+	// Only the limits standing in the way decide how long to wait - when allowed, that's all of them
+	for _, result := range results {
+		if !combined.Allowed && result.Allowed {
+			continue
+		}
+		if result.RetryAfter > combined.RetryAfter {
+			combined.RetryAfter = result.RetryAfter
+			combined.ResetTime = result.ResetTime
+			if !combined.Allowed {
+				combined.Policy = result.Policy // Report the limit that's actually keeping them out
+			}
+		}
+	}
+	if combined.Policy == "" && len(results) > 0 {
+		combined.Policy = results[0].Policy
+	}
+	return combined
+}
@@ -13,25 +13,36 @@ type PermissiveRateLimiter struct {
 	redisClient *redis.Client
 }
 
-func NewPermissiveRateLimiter(redisClient *redis.Client, windowSize time.Duration, defaultLimit int64) RateLimiter {
+func NewPermissiveRateLimiter(redisClient *redis.Client, windowSize time.Duration, defaultLimit int64) (RateLimiter, error) {
 	//  Initialize the limiter - we don't actually use the client
 	return &PermissiveRateLimiter{
 		redisClient: redisClient, // So this can be NIL
-	}
+	}, nil
 }
 
 // CheckLimit implements the RateLimiter interface
-func (c *PermissiveRateLimiter) CheckLimit(ctx context.Context, accountID int64, path string) (*types.RateLimitResult, error) {
+func (c *PermissiveRateLimiter) CheckLimit(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error) {
 	result := &types.RateLimitResult{
 		ResetTime:  time.Now(),
 		RetryAfter: -1,
 		Allowed:    true,
 		Limit:      -1,
 		Remaining:  -1,
+		Policy:     req.Policy,
 	}
 	return result, nil
 }
 
+// Peek implements the RateLimiter interface - always allowed
+func (c *PermissiveRateLimiter) Peek(ctx context.Context, req *types.RateLimitRequest) (*types.RateLimitResult, error) {
+	return c.CheckLimit(ctx, req)
+}
+
+// Consume implements the RateLimiter interface - nothing to count
+func (c *PermissiveRateLimiter) Consume(ctx context.Context, req *types.RateLimitRequest) error {
+	return nil
+}
+
 // Close gracefully shuts down the rate limiter
 func (c *PermissiveRateLimiter) Close() error {
 	// This stores nothing local
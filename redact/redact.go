@@ -0,0 +1,151 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Masked is what a secret is replaced with - you can still see that something was set
+const Masked = "[REDACTED]"
+
+// Secrets shorter than this aren't scrubbed from logs - masking every "a" or "12" would mangle everything else
+const minScrubLength = 4
+
+// Query parameters that carry credentials often enough to mask wherever they turn up
+var sensitiveParams = map[string]bool{
+	"password":     true,
+	"passwd":       true,
+	"secret":       true,
+	"token":        true,
+	"access_token": true,
+	"api_key":      true,
+	"apikey":       true,
+	"key":          true,
+	"sig":          true,
+	"signature":    true,
+}
+
+// URL strips the credentials from a URL or address for logging - userinfo goes entirely, and credential-looking
+// query parameters are masked. Plain host:port addresses (eg Redis) only lose a user:password@ prefix
+func URL(raw string) string {
+	if !strings.Contains(raw, "://") {
+		if at := strings.LastIndex(raw, "@"); at >= 0 {
+			return raw[at+1:]
+		}
+		return raw
+	}
+
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return Masked // Can't tell which part is the secret, so none of it gets logged
+	}
+	parsed.User = nil
+	if parsed.RawQuery != "" {
+		query := parsed.Query()
+		for param := range query {
+			if sensitiveParams[strings.ToLower(param)] {
+				query.Set(param, Masked)
+			}
+		}
+		parsed.RawQuery = strings.ReplaceAll(query.Encode(), url.QueryEscape(Masked), Masked) // Readable in the log
+	}
+	return parsed.String()
+}
+
+// URLPassword returns the password in a URL's userinfo (or a host:port address's user:password@ prefix), if it has one
+func URLPassword(raw string) string {
+	if !strings.Contains(raw, "://") {
+		if at := strings.LastIndex(raw, "@"); at >= 0 {
+			if _, password, found := strings.Cut(raw[:at], ":"); found {
+				return password
+			}
+		}
+		return ""
+	}
+	if parsed, err := url.Parse(raw); err == nil && parsed.User != nil {
+		password, _ := parsed.User.Password()
+		return password
+	}
+	return ""
+}
+
+// Writer masks known secret values in everything written through it. Put it under every logger, so a secret that
+// ends up in a log line by accident - in an error message, a URL, a debug dump - still doesn't reach the log store.
+//
+// Output goes out a line at a time, so a secret split over two writes is still caught. Loggers end every entry with
+// a newline, so nothing's held back for them - anything else is held until its line ends (or maxPending builds up)
+type Writer struct {
+	out io.Writer
+
+	mu       sync.Mutex
+	secrets  map[string]bool
+	replacer *strings.Replacer // nil until there's something to mask
+	pending  []byte            // The start of a line whose end hasn't been written yet
+}
+
+// A line that gets this long without ending is written out anyway - masked as far as it goes
+const maxPending = 64 * 1024
+
+func NewWriter(out io.Writer) *Writer {
+	return &Writer{out: out, secrets: make(map[string]bool)}
+}
+
+// Mask adds values to mask from now on. Old values stay masked after they're rotated out - they're still secrets
+func (w *Writer) Mask(secrets ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	added := false
+	for _, secret := range secrets {
+		if len(secret) >= minScrubLength && !w.secrets[secret] {
+			w.secrets[secret] = true
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+
+	masks := make([]string, 0, len(w.secrets))
+	for secret := range w.secrets {
+		masks = append(masks, secret)
+	}
+	// Longest first, so a secret containing another is masked whole
+	sort.Slice(masks, func(i, j int) bool { return len(masks[i]) > len(masks[j]) })
+	pairs := make([]string, 0, 2*len(masks))
+	for _, secret := range masks {
+		pairs = append(pairs, secret, Masked)
+	}
+	w.replacer = strings.NewReplacer(pairs...)
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.replacer == nil && len(w.pending) == 0 {
+		return w.out.Write(p)
+	}
+	w.pending = append(w.pending, p...)
+	end := bytes.LastIndexByte(w.pending, '\n') + 1
+	if end == 0 {
+		if len(w.pending) < maxPending {
+			return len(p), nil
+		}
+		end = len(w.pending)
+	}
+
+	lines := string(w.pending[:end])
+	w.pending = append(w.pending[:0], w.pending[end:]...)
+	if w.replacer != nil {
+		lines = w.replacer.Replace(lines)
+	}
+	if _, err := io.WriteString(w.out, lines); err != nil {
+		return 0, err
+	}
+	return len(p), nil // What we were given was all written (or held), even if the masked line is a different length
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"rate-limiter/config"
+	"rate-limiter/metrics"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	configReloads    = metrics.NewCounter("ratelimiter_config_reloads_total", "Config reload attempts, by result", "result")
+	configReloadedAt = metrics.NewGauge("ratelimiter_config_last_reload_success_timestamp_seconds", "When the running config was loaded")
+)
+
+// reloader serves requests with the current RateLimitingProxy, and swaps in a new one when the config changes -
+// on SIGHUP, or when the modification time of the config file, any file it includes, or a secret file moves -
+// so rotating a mounted secret takes effect without a restart.
+//
+// A new config goes through the same Load + Validate as at startup; if it fails, the last good config stays.
+// Each request runs start to finish against one proxy, so it never sees half of one config and half of another.
+// Connections and shared state (Redis, revocation cache, in-flight leases, adaptive multiplier) carry over -
+// changing their settings still needs a restart, apart from Redis credentials, which new connections pick up
+type reloader struct {
+	opts      *cliOptions // The config file, and over-rides that have to survive a reload
+	path      string
+	redClient *redis.Client
+	current   atomic.Pointer[RateLimitingProxy]
+
+	mu       sync.Mutex // One reload at a time
+	files    []string   // The config file, its includes and secret files, as of the last reload
+	modTimes string     // Of those files
+}
+
+func newReloader(opts *cliOptions, proxy *RateLimitingProxy, redClient *redis.Client) *reloader {
+	rel := &reloader{opts: opts, path: config.ResolvePath(opts.configPath), redClient: redClient}
+	rel.current.Store(proxy)
+	rel.watch(proxy.config.Files)
+	configReloadedAt.Set(float64(time.Now().Unix()))
+	return rel
+}
+
+func (rel *reloader) ServeHTTP(wtr http.ResponseWriter, req *http.Request) {
+	rel.current.Load().handler.ServeHTTP(wtr, req)
+}
+
+// Start listens for SIGHUP, and polls the config file if a watch interval is configured
+func (rel *reloader) Start() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			rel.Reload("SIGHUP")
+		}
+	}()
+
+	interval := rel.current.Load().config.WatchInterval
+	if interval <= 0 {
+		InfoLogger.Printf("Config file watching off - reload %s with SIGHUP", rel.path)
+		return
+	}
+	InfoLogger.Printf("Watching %s for changes every %s", rel.path, interval)
+	go func() {
+		ticker := time.NewTicker(interval) // Fixed at startup, like the other server settings
+		defer ticker.Stop()
+		for range ticker.C {
+			rel.mu.Lock()
+			changed := fileModTimes(rel.files) != rel.modTimes
+			rel.mu.Unlock()
+			if changed {
+				rel.Reload("file change")
+			}
+		}
+	}()
+}
+
+// Reload loads, validates and swaps in the config. The running config is untouched if anything fails
+func (rel *reloader) Reload(trigger string) error {
+	rel.mu.Lock()
+	defer rel.mu.Unlock()
+
+	InfoLogger.Printf("Reloading configuration from %s (%s)", rel.path, trigger)
+
+	old := rel.current.Load()
+	proxy, files, err := rel.build(old)
+	rel.watch(files) // Even if it's bad - don't retry the same broken file every tick
+	if err != nil {
+		configReloads.Inc("failure")
+		ErrorLogger.Printf("Config reload rejected - keeping the running config: %v", err)
+		return err
+	}
+
+	warnRestartOnly(old.config, proxy.config)
+	redisAuth.Set(proxy.config.RedisConfig)
+	rel.current.Store(proxy)
+	old.backends.StopUnused(proxy.backends)
+	configReloads.Inc("success")
+	configReloadedAt.Set(float64(time.Now().Unix()))
+	InfoLogger.Println("Configuration reloaded")
+	printConfigSummary(proxy.config)
+	return nil
+}
+
+// build makes a proxy from the config as it is now, and returns the files that went into it - the config file,
+// its includes and any secret files - whether or not it worked
+func (rel *reloader) build(old *RateLimitingProxy) (*RateLimitingProxy, []string, error) {
+	// No config file at all is fine (env vars only), same as at startup - unless one was asked for
+	files, err := config.CheckFile(rel.path)
+	if err != nil && (rel.opts.configPath != "" || !errors.Is(err, os.ErrNotExist)) {
+		return nil, append(files, old.config.Files...), fmt.Errorf("unable to read %s: %w", rel.path, err)
+	}
+	cfg, err := loadConfig(rel.opts)
+	if err != nil {
+		return nil, cfg.Files, fmt.Errorf("invalid config: %w", err)
+	}
+
+	limiters, err := buildLimiters(cfg, rel.redClient)
+	if err != nil {
+		return nil, cfg.Files, fmt.Errorf("unable to build limiters: %w", err)
+	}
+
+	proxy, err := setupProxy(cfg, limiters, old.revocations, old.concurrency, old.adaptive, old.backends)
+	if err != nil {
+		return nil, cfg.Files, err
+	}
+	proxy.backends.Start() // Only once the proxy's good - a rejected reload leaves nothing new running
+	if cap(old.throttleQueue) == cap(proxy.throttleQueue) {
+		proxy.throttleQueue = old.throttleQueue // Requests already waiting still count against the queue
+	}
+	return proxy, cfg.Files, nil
+}
+
+// watch notes the files to poll, and their modification times as of now
+func (rel *reloader) watch(files []string) {
+	seen := map[string]bool{}
+	rel.files = nil
+	for _, file := range append([]string{rel.path}, files...) {
+		if !seen[file] {
+			seen[file] = true
+			rel.files = append(rel.files, file)
+		}
+	}
+	rel.modTimes = fileModTimes(rel.files)
+}
+
+// warnRestartOnly flags changed settings that a reload can't apply
+func warnRestartOnly(old, updated *config.Config) {
+	restartOnly := map[string]bool{
+		"server_config":                old.ServerConfig != updated.ServerConfig,
+		"tls_config":                   !reflect.DeepEqual(old.TLSConfig, updated.TLSConfig), // Not the files' contents - those reload
+		"redis_config":                 withoutCredentials(old.RedisConfig) != withoutCredentials(updated.RedisConfig),
+		"revocation_config":            old.RevocationConfig != updated.RevocationConfig,
+		"adaptive_config":              old.AdaptiveConfig != updated.AdaptiveConfig,
+		"concurrency_config.lease_ttl": old.ConcurrencyConfig.LeaseTTL != updated.ConcurrencyConfig.LeaseTTL,
+		"config_watch_interval":        old.WatchInterval != updated.WatchInterval,
+	}
+	for setting, changed := range restartOnly {
+		if changed {
+			ErrorLogger.Printf("Config %s changed - it only takes effect on restart", setting)
+		}
+	}
+}
+
+// Redis credentials are applied on reload - new connections use them
+func withoutCredentials(redisConfig config.RedisConfig) config.RedisConfig {
+	redisConfig.Username, redisConfig.Password = "", ""
+	return redisConfig
+}
+
+// fileModTimes fingerprints the files' modification times. A file that can't be read counts as zero -
+// a missing file counts as a change once it reappears
+func fileModTimes(paths []string) string {
+	var stamps strings.Builder
+	for _, path := range paths {
+		var modTime time.Time
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+		fmt.Fprintf(&stamps, "%s=%d;", path, modTime.UnixNano())
+	}
+	return stamps.String()
+}
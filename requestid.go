@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID makes sure every request has an ID - the caller's own if it's sane, otherwise a fresh one.
+// It's echoed back on the response, passed to the backend, and included in error bodies
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wtr http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			req.Header.Set(requestIDHeader, id)
+		}
+		wtr.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(wtr, req)
+	})
+}
+
+func requestIDFrom(req *http.Request) string {
+	return req.Header.Get(requestIDHeader)
+}
+
+// Caller-supplied IDs end up in our logs and the backend's - keep them short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, char := range id {
+		if char <= ' ' || char > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf) // Never returns an error
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,212 @@
+package revocation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	InfoLogger  = log.New(os.Stdout, "[Revocation] INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+	ErrorLogger = log.New(os.Stderr, "[Revocation] ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+)
+
+const (
+	key_prefix        string = "rlrev" // 'rate limiter revocation'
+	key_token_proto   string = "%s:jti:%s"
+	key_subject_proto string = "%s:sub:%s"
+)
+
+// ErrInvalid wraps revocations that can't be made as asked - the caller's mistake, rather than the store's
+var ErrInvalid = errors.New("invalid revocation")
+
+// A cached lookup - revokedAt is zero when nothing is revoked
+type cacheEntry struct {
+	revokedAt time.Time
+	expires   time.Time
+}
+
+// Store is a Redis-backed deny-list for JWTs, keyed by token ID (jti) and by subject.
+//
+//	jti revocations kill one token, and expire along with it
+//	subject revocations kill every token for that subject issued *before* the revocation
+//
+// Lookups are cached locally for a short time, so a revocation can take up to cacheTTL to reach every instance
+type Store struct {
+	client     *redis.Client
+	cacheTTL   time.Duration
+	maxEntries int
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+func NewStore(client *redis.Client, cacheTTL time.Duration, maxEntries int) *Store {
+	return &Store{
+		client:     client,
+		cacheTTL:   cacheTTL,
+		maxEntries: maxEntries,
+		cache:      make(map[string]cacheEntry),
+	}
+}
+
+func tokenKey(jti string) string {
+	return fmt.Sprintf(key_token_proto, key_prefix, jti)
+}
+
+func subjectKey(subject string) string {
+	return fmt.Sprintf(key_subject_proto, key_prefix, subject)
+}
+
+// RevokeToken denies a single token until it would have expired anyway
+func (s *Store) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return fmt.Errorf("%w: token ID (jti) is required", ErrInvalid)
+	}
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return fmt.Errorf("%w: token %s has already expired at %s", ErrInvalid, jti, expiresAt)
+	}
+	return s.revoke(ctx, tokenKey(jti), ttl)
+}
+
+// RevokeSubject denies every token for the subject issued up to now.
+// ttl should be at least the longest token lifetime we issue, or old tokens come back to life
+func (s *Store) RevokeSubject(ctx context.Context, subject string, ttl time.Duration) error {
+	if subject == "" {
+		return fmt.Errorf("%w: subject is required", ErrInvalid)
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("%w: TTL %s for subject %s", ErrInvalid, ttl, subject)
+	}
+	return s.revoke(ctx, subjectKey(subject), ttl)
+}
+
+func (s *Store) revoke(ctx context.Context, key string, ttl time.Duration) error {
+	now := time.Now()
+	if err := s.client.Set(ctx, key, now.Unix(), ttl).Err(); err != nil {
+		return fmt.Errorf("unable to store revocation %s: %w", key, err)
+	}
+	s.store(key, now)
+	InfoLogger.Printf("Revoked %s for %s", key, ttl)
+	return nil
+}
+
+// RestoreToken lifts a jti revocation
+func (s *Store) RestoreToken(ctx context.Context, jti string) error {
+	return s.restore(ctx, tokenKey(jti))
+}
+
+// RestoreSubject lifts a subject revocation
+func (s *Store) RestoreSubject(ctx context.Context, subject string) error {
+	return s.restore(ctx, subjectKey(subject))
+}
+
+func (s *Store) restore(ctx context.Context, key string) error {
+	if err := s.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("unable to remove revocation %s: %w", key, err)
+	}
+	s.store(key, time.Time{})
+	InfoLogger.Printf("Removed revocation %s", key)
+	return nil
+}
+
+// TokenRevokedAt returns when the jti was revoked - zero time if it isn't
+func (s *Store) TokenRevokedAt(ctx context.Context, jti string) (time.Time, error) {
+	return s.lookup(ctx, tokenKey(jti))
+}
+
+// SubjectRevokedAt returns when the subject was revoked - zero time if it isn't
+func (s *Store) SubjectRevokedAt(ctx context.Context, subject string) (time.Time, error) {
+	return s.lookup(ctx, subjectKey(subject))
+}
+
+// IsRevoked checks a token against both deny-lists. Tokens with no iat are treated as issued at the epoch,
+// so a subject revocation always catches them
+func (s *Store) IsRevoked(ctx context.Context, jti, subject string, issuedAt time.Time) (bool, error) {
+	if jti != "" {
+		revokedAt, err := s.TokenRevokedAt(ctx, jti)
+		if err != nil {
+			return false, err
+		}
+		if !revokedAt.IsZero() {
+			return true, nil
+		}
+	}
+
+	if subject != "" {
+		revokedAt, err := s.SubjectRevokedAt(ctx, subject)
+		if err != nil {
+			return false, err
+		}
+		if !revokedAt.IsZero() && !issuedAt.After(revokedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) lookup(ctx context.Context, key string) (time.Time, error) {
+	if revokedAt, ok := s.cached(key); ok {
+		return revokedAt, nil
+	}
+
+	val, err := s.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		s.store(key, time.Time{})
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to read revocation %s: %w", key, err)
+	}
+
+	unixTime, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		// Something's in there, we just can't read it - treat as revoked right now rather than let it through
+		ErrorLogger.Printf("Non-parsable revocation timestamp in %s - %v: %v", key, val, err)
+		unixTime = time.Now().Unix()
+	}
+	revokedAt := time.Unix(unixTime, 0)
+	s.store(key, revokedAt)
+	return revokedAt, nil
+}
+
+func (s *Store) cached(key string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return time.Time{}, false
+	}
+	return entry.revokedAt, true
+}
+
+func (s *Store) store(key string, revokedAt time.Time) {
+	if s.cacheTTL <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if len(s.cache) >= s.maxEntries {
+		// Cheap eviction - drop anything stale, and if that doesn't make room start over
+		for k, entry := range s.cache {
+			if now.After(entry.expires) {
+				delete(s.cache, k)
+			}
+		}
+		if len(s.cache) >= s.maxEntries {
+			s.cache = make(map[string]cacheEntry)
+		}
+	}
+	s.cache[key] = cacheEntry{revokedAt: revokedAt, expires: now.Add(s.cacheTTL)}
+}
@@ -42,11 +42,13 @@ REM Create .env file in docker directory
 echo # Rate Limiter Environment Configuration > docker\.env
 echo # Generated on %date% %time% >> docker\.env
 echo. >> docker\.env
-echo # Redis Configuration >> docker\.env
-echo redis_password=!redis_password! >> docker\.env
+echo # Read by docker-compose - it passes them on to the containers >> docker\.env
+echo redis_password=!redis_password!>> docker\.env
+echo JWT_SECRET=!jwt_secret!>> docker\.env
 echo. >> docker\.env
-echo # JWT Configuration >> docker\.env
-echo jwt_secret=!jwt_secret! >> docker\.env
+echo # The same, by the names the proxy reads when run outside Docker (go run . loads this file) >> docker\.env
+echo RL_REDIS_CONFIG__REDIS_PASSWORD=!redis_password!>> docker\.env
+echo RL_JWT_SECRET=!jwt_secret!>> docker\.env
 
 echo New credentials generated and saved to docker\.env
 echo WARNING: New Redis password means existing Redis data will be inaccessible
@@ -14,6 +14,12 @@ if [ -f docker/.env ]; then
     if [[ ! "$regenerate" =~ ^[Yy]$ ]]; then
         echo "Using existing credentials..."
         echo ""
+        # Files from older versions of this script name the JWT secret jwt_secret - docker-compose wants JWT_SECRET
+        if ! grep -q '^JWT_SECRET=' docker/.env && grep -q '^jwt_secret=' docker/.env; then
+            echo "Renaming jwt_secret to JWT_SECRET in docker/.env"
+            sed -i.bak 's/^jwt_secret=/JWT_SECRET=/' docker/.env && rm -f docker/.env.bak
+            echo ""
+        fi
     else
         echo "Creating backup of existing .env..."
         cp docker/.env docker/.env.backup
@@ -50,11 +56,13 @@ if [ "$generate_new" = true ]; then
 # Rate Limiter Environment Configuration
 # Generated on $(date)
 
-# Redis Configuration
+# Read by docker-compose - it passes them on to the containers
 redis_password=$redis_password
+JWT_SECRET=$jwt_secret
 
-# JWT Configuration
-jwt_secret=$jwt_secret
+# The same, by the names the proxy reads when run outside Docker (go run . loads this file)
+RL_REDIS_CONFIG__REDIS_PASSWORD=$redis_password
+RL_JWT_SECRET=$jwt_secret
 EOF
 
     echo "New credentials generated and saved to docker/.env"
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"rate-limiter/config"
+	"rate-limiter/metrics"
+	"rate-limiter/ratelimiter"
+	"rate-limiter/types"
+	"time"
+)
+
+var throttledRequests = metrics.NewCounter("ratelimiter_throttled_requests_total", "Requests held on throttled endpoints, by outcome", "outcome")
+
+// Never sleep less than this between looks - RetryAfter rounds down to 0 near a bucket boundary
+const minThrottleWait = 10 * time.Millisecond
+
+// awaitCapacity holds a request on a throttled endpoint until its limits would let it through, rather than
+// rejecting it straight away. It only peeks while waiting, so a held request isn't counted until it's actually checked.
+//
+// Gives up - and leaves the request to be rejected as normal - when the wait would run past the endpoint's max_delay,
+// or the throttle queue is already full. An error means the limits couldn't be checked at all
+func (prox *RateLimitingProxy) awaitCapacity(ctx context.Context, req *http.Request, limitReq *types.RateLimitRequest, checks []ratelimiter.LimitCheck) error {
+	endpoint, ok := prox.matchEndpoint(req, func(e config.EndpointPolicy) bool { return e.Mode == config.ModeThrottle })
+	if !ok {
+		return nil
+	}
+
+	deadline := time.Now().Add(endpoint.MaxDelay)
+	queued := false
+	defer func() {
+		if queued {
+			<-prox.throttleQueue
+		}
+	}()
+
+	for {
+		result, err := ratelimiter.PeekLimits(ctx, checks)
+		if err != nil {
+			return err
+		}
+		if result.Allowed {
+			if queued {
+				throttledRequests.Inc("delayed")
+			}
+			return nil
+		}
+
+		wait := max(result.RetryAfter, minThrottleWait)
+		if time.Now().Add(wait).After(deadline) {
+			InfoLogger.Printf("Throttled request for account %d (%s) on %s would wait %s - over max delay %s", limitReq.AccountID, limitReq.Subject, req.URL.Path, wait, endpoint.MaxDelay)
+			throttledRequests.Inc("timed_out")
+			return nil
+		}
+
+		if !queued {
+			select {
+			case prox.throttleQueue <- struct{}{}:
+				queued = true
+			default:
+				InfoLogger.Printf("Throttle queue full - not holding request for account %d (%s) on %s", limitReq.AccountID, limitReq.Subject, req.URL.Path)
+				throttledRequests.Inc("queue_full")
+				return nil
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done(): // Client gave up
+			timer.Stop()
+			throttledRequests.Inc("cancelled")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"rate-limiter/config"
+	"rate-limiter/metrics"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	certExpiry  = metrics.NewGauge("ratelimiter_tls_cert_expiry_timestamp_seconds", "When the listener's certificate expires")
+	certReloads = metrics.NewCounter("ratelimiter_tls_cert_reloads_total", "Listener cert, key and client CA reloads, by result", "result")
+)
+
+// listenerCerts holds the listener's certificate and client CA pool, and swaps in new ones when their files change -
+// so a renewed cert (eg from cert-manager) is served on new connections without a restart. Connections already
+// open carry on with the cert they were set up with
+type listenerCerts struct {
+	settings config.ListenerTLSConfig
+	current  atomic.Pointer[tls.Config]
+	modTimes string // Of the files, as of the last load - good or bad
+}
+
+func newListenerCerts(settings config.ListenerTLSConfig) (*listenerCerts, error) {
+	certs := &listenerCerts{settings: settings}
+	certs.modTimes = fileModTimes(certs.files())
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func (certs *listenerCerts) files() []string {
+	files := []string{certs.settings.CertFile, certs.settings.KeyFile}
+	if certs.settings.ClientCAFile != "" {
+		files = append(files, certs.settings.ClientCAFile)
+	}
+	return files
+}
+
+// load reads the files and builds the TLS config new connections get. It leaves the current one alone if they don't load
+func (certs *listenerCerts) load() error {
+	cert, err := tls.LoadX509KeyPair(certs.settings.CertFile, certs.settings.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS cert %s: %w", certs.settings.CertFile, err)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if certs.settings.ClientCAFile != "" {
+		pem, err := os.ReadFile(certs.settings.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read client CA file: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", certs.settings.ClientCAFile)
+		}
+	}
+
+	certs.current.Store(tlsConfig)
+	if leaf := cert.Leaf; leaf != nil {
+		certExpiry.Set(float64(leaf.NotAfter.Unix()))
+		InfoLogger.Printf("Serving TLS cert for %v, expiring %s", leaf.DNSNames, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Start checks the files for changes every cert_reload_interval
+func (certs *listenerCerts) Start() {
+	go func() {
+		ticker := time.NewTicker(certs.settings.ReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			modTimes := fileModTimes(certs.files())
+			if modTimes == certs.modTimes {
+				continue
+			}
+			// A cert and key are seldom written at the same instant - if they don't match yet, writing the
+			// other one moves the mod times again, and it's tried again then
+			certs.modTimes = modTimes
+			if err := certs.load(); err != nil {
+				certReloads.Inc("failure")
+				ErrorLogger.Printf("TLS cert reload failed - still serving the previous one: %v", err)
+				continue
+			}
+			certReloads.Inc("success")
+			InfoLogger.Println("TLS cert reloaded")
+		}
+	}()
+}
+
+// TLSConfig is the listener's TLS config. Each handshake takes the cert and client CAs as they are at that moment
+func (certs *listenerCerts) TLSConfig(http2 bool) *tls.Config {
+	minVersion, _ := config.TLSVersion(certs.settings.MinVersion)
+	base := &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: []string{"http/1.1"},
+		ClientAuth: tls.NoClientCert,
+	}
+	if http2 {
+		base.NextProtos = []string{"h2", "http/1.1"}
+	}
+	for _, name := range certs.settings.CipherSuites {
+		id, _, _ := config.CipherSuite(name)
+		base.CipherSuites = append(base.CipherSuites, id)
+	}
+	switch certs.settings.ClientAuth {
+	case config.ClientAuthOptional:
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case config.ClientAuthRequire:
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &certs.current.Load().Certificates[0], nil
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		loaded := certs.current.Load()
+		handshake := base.Clone()
+		handshake.GetConfigForClient, handshake.GetCertificate = nil, nil
+		handshake.Certificates = loaded.Certificates
+		handshake.ClientCAs = loaded.ClientCAs
+		return handshake, nil
+	}
+	return base
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -13,9 +15,10 @@ import (
 // JWTClaims represents the structure of our JWT claims
 // This matches the commented structure in main.go
 type JWTClaims struct {
-	AccountID            int64  `json:"account_id"` // Account ID for rate limiting
-	UserID               string `json:"sub"`        // Subject - user identifier
-	Role                 string `json:"role"`       // User role (e.g., "admin", "user")
+	AccountID            int64  `json:"account_id"`         // Account ID for rate limiting
+	UserID               string `json:"sub"`                // Subject - user identifier
+	Role                 string `json:"role"`               // User role (e.g., "admin", "user")
+	Priority             string `json:"priority,omitempty"` // Priority class (low, normal, high)
 	jwt.RegisteredClaims        // Standard JWT claims (exp, iat, etc.)
 }
 
@@ -45,6 +48,7 @@ func main() {
 		userID      = flag.String("user", "", "User ID/subject")
 		accountID   = flag.Int64("account", 0, "Account ID for rate limiting")
 		role        = flag.String("role", "user", "User role (user, admin)")
+		priority    = flag.String("priority", "", "Priority class (low, normal, high) - omitted if empty")
 		preset      = flag.String("preset", "", "Use predefined user (user1, admin1, user2)")
 		duration    = flag.String("duration", "24h", "Token validity duration (e.g., 1h, 24h, 7d)")
 		listPresets = flag.Bool("list", false, "List available presets")
@@ -94,9 +98,14 @@ func main() {
 		}
 	}
 
+	if *priority != "" {
+		claims.Priority = *priority
+	}
+
 	// Set standard claims
 	now := time.Now()
 	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        newTokenID(), // jti - lets the proxy revoke this one token
 		IssuedAt:  jwt.NewNumericDate(now),
 		ExpiresAt: jwt.NewNumericDate(now.Add(tokenDuration)),
 		NotBefore: jwt.NewNumericDate(now),
@@ -130,3 +139,12 @@ func main() {
 		log.Fatalf("Unknown output format: %s (use: token, header, curl, json)", *output)
 	}
 }
+
+// newTokenID generates a random jti
+func newTokenID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatalf("Failed to generate token ID: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -25,17 +25,35 @@ type EndpointConfig struct {
 
 // RateLimitRequest represents a request to check rate limiting
 type RateLimitRequest struct {
-	AccountID   int64         `json:"account_id"`
+	AccountID   int64         `json:"account_id"` // -1 for anonymous traffic
+	Subject     string        `json:"subject"`    // Who the counters belong to - account ID, or client IP prefix for anonymous traffic
+	Policy      string        `json:"policy"`     // Name of the limit being checked - keeps counters for different limits apart
 	RequestPath string        `json:"request_path"`
-	Limit       int64         `json:"limit"`
-	Period      time.Duration `json:"period"`
+	Limit       int64         `json:"limit"`    // 0 uses the limiter's default
+	Period      time.Duration `json:"period"`   // 0 uses the limiter's default
+	Calendar    string        `json:"calendar"` // Calendar quotas only - "day" or "month"
+	Timezone    string        `json:"timezone"` // Calendar quotas only - IANA zone the calendar resets in, UTC if empty
+	Cost        int64         `json:"cost"`     // Units this request uses up - 0 counts as 1
+	Priority    string        `json:"priority"` // Priority class - lower classes only get a share of each limit
+}
+
+// Units a request costs - every request costs something
+func (req *RateLimitRequest) Units() int64 {
+	if req.Cost > 0 {
+		return req.Cost
+	}
+	return 1
 }
 
 // RateLimitResult represents the result of a rate limit check
 type RateLimitResult struct {
-	Allowed    bool          // Proceed or not
-	Limit      int64         // configured cap
-	Remaining  int64         // remaining in-window for current user
-	ResetTime  time.Time     // Window expiration time (not always useful - sliding window?)
-	RetryAfter time.Duration // GO AWAY until...`
+	Allowed      bool               // Proceed or not
+	Limit        int64              // configured cap
+	Remaining    int64              // remaining in-window for current user
+	ResetTime    time.Time          // Window expiration time (not always useful - sliding window?)
+	RetryAfter   time.Duration      // GO AWAY until...`
+	Policy       string             // Which limit produced this result - the most restrictive one, when several are combined
+	Window       time.Duration      // Length of the limit's window (or calendar period) - 0 if it doesn't have one
+	ShadowDenied []string           // Limits in shadow mode (not enforced) that would have denied the request
+	Policies     []*RateLimitResult // The enforced limits a combined result was built from
 }
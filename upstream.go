@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"rate-limiter/config"
+	"rate-limiter/metrics"
+	"sync"
+	"time"
+)
+
+var (
+	backendRetries = metrics.NewCounter("ratelimiter_backend_retries_total", "Requests sent to the backend again, by what went wrong the time before", "reason")
+	retriesDenied  = metrics.NewCounter("ratelimiter_backend_retries_denied_total", "Retries not made because the retry budget was spent")
+)
+
+// Retries and requests are counted over two of these - the retry budget looks back between one and two windows
+const retryBudgetWindow = 10 * time.Second
+
+// Methods that are safe to send twice (RFC 9110) - others are only retried when the backend never saw them
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// Connections are pooled per transport, so routes with the same connection timeouts share them - across reloads too
+type transportKey struct {
+	dial, tlsHandshake, responseHeader time.Duration
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = map[transportKey]*http.Transport{}
+)
+
+// transportFor returns the transport with a policy's connection timeouts
+func transportFor(policy config.UpstreamPolicy) *http.Transport {
+	key := transportKey{policy.DialTimeout, policy.TLSHandshakeTimeout, policy.ResponseHeaderTimeout}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if transport, exists := transports[key]; exists {
+		return transport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: policy.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = policy.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = policy.ResponseHeaderTimeout
+	transports[key] = transport
+	return transport
+}
+
+// upstreamTransport sends proxied requests to the target picked for them, and again - to a freshly picked target -
+// when they fail in a way the route retries. It also keeps each target's health and in-flight count up to date
+type upstreamTransport struct {
+	backends *backendPool
+}
+
+func (tr *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state, ok := proxiedRequestFrom(req.Context())
+	if !ok {
+		return http.DefaultTransport.RoundTrip(req) // Only proxied requests come through here - they all have state
+	}
+	transport := transportFor(state.policy)
+	retry := state.policy.Retry
+
+	var replay func() io.ReadCloser
+	replayable := false
+	if retry.MaxAttempts > 1 {
+		replay, replayable = replayBody(req, retry.MaxReplayBody)
+	}
+	tr.backends.budget.Request()
+
+	up := state.upstream
+	attemptReq := req
+	for attempt := 1; ; attempt++ {
+		admitted, breakerDone, allowed := tr.admit(state, up)
+		if !allowed {
+			return nil, errCircuitOpen
+		}
+		if admitted != up {
+			up = admitted // Its circuit opened since it was picked
+			state.upstream = up
+			attemptReq = attemptReq.Clone(req.Context())
+			attemptReq.URL = up.targetURL(state.inboundURL)
+		}
+
+		done := up.Forward()
+		resp, err := transport.RoundTrip(attemptReq)
+		breakerDone(callOutcome(req, resp, err))
+		if err != nil {
+			done()
+			if req.Context().Err() == nil { // The client going away isn't the target's fault
+				up.health.ProxyFailed(err)
+			}
+		} else {
+			up.health.ProxyResponded()
+		}
+
+		reason := retryReason(req, resp, err)
+		if reason == "" || !retry.RetriesOn(reason) || attempt >= retry.MaxAttempts || !replayable ||
+			(!idempotentMethods[req.Method] && reason != config.RetryConnectError) {
+			if err == nil {
+				resp.Body = &forwardedBody{ReadCloser: resp.Body, done: done}
+			}
+			return resp, err
+		}
+		if !tr.backends.budget.Withdraw() {
+			retriesDenied.Inc()
+			if err == nil {
+				resp.Body = &forwardedBody{ReadCloser: resp.Body, done: done}
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // So the connection can be reused
+			resp.Body.Close()
+			done()
+		}
+		backendRetries.Inc(reason)
+		InfoLogger.Printf("Retrying %s %s (attempt %d of %d) after %s from %s", req.Method, state.inboundURL.Path, attempt+1,
+			retry.MaxAttempts, reason, up.name)
+		if err := backoff(req.Context(), retry, attempt); err != nil {
+			return nil, err // Client gave up, or the route's timeout ran out
+		}
+
+		if next := tr.backends.Pick(state.limitReq); next != nil {
+			up = next // Maybe the same one - with consistent hashing it will be, unless it's been marked down
+		}
+		state.upstream = up
+		attemptReq = req.Clone(req.Context())
+		attemptReq.URL = up.targetURL(state.inboundURL)
+		attemptReq.Body = replay()
+	}
+}
+
+// admit gets the request past a circuit breaker - the picked target's, or if that won't let it through, another's
+func (tr *upstreamTransport) admit(state *proxiedRequest, up *upstream) (*upstream, func(callResult), bool) {
+	for tries := 0; tries <= len(tr.backends.upstreams); tries++ {
+		if done, allowed := up.breaker.Allow(); allowed {
+			return up, done, true
+		}
+		if up = tr.backends.Pick(state.limitReq); up == nil {
+			break
+		}
+	}
+	return nil, nil, false
+}
+
+// callOutcome is what an attempt tells the circuit breaker about the target
+func callOutcome(req *http.Request, resp *http.Response, err error) callResult {
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		return callAbandoned
+	case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+		return callFailed // Including the route's timeout running out
+	}
+	return callSucceeded
+}
+
+// retryReason names what went wrong with an attempt, in retry_on's terms - "" if it went fine, or can't be retried
+func retryReason(req *http.Request, resp *http.Response, err error) string {
+	if err != nil {
+		var opErr *net.OpError
+		var netErr net.Error
+		switch {
+		case req.Context().Err() != nil:
+			return "" // The client's gone, or the route's timeout is up - there's no time for another go
+		case errors.As(err, &opErr) && opErr.Op == "dial":
+			return config.RetryConnectError
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return "" // The backend took the request and sat on it - sending it again would likely do the same
+		default:
+			return config.RetryReset
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway:
+		return config.Retry502
+	case http.StatusServiceUnavailable:
+		return config.Retry503
+	case http.StatusGatewayTimeout:
+		return config.Retry504
+	}
+	return ""
+}
+
+// isTimeout is true when the backend was too slow, rather than unreachable - the route's timeout, or its
+// response_header_timeout
+func isTimeout(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false // Couldn't connect in time is the backend being unavailable
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// replayBody holds on to the request body so it can be sent again. Bodies bigger than maxReplay are streamed
+// through untouched, and can't be retried
+func replayBody(req *http.Request, maxReplay int64) (replay func() io.ReadCloser, replayable bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() io.ReadCloser { return http.NoBody }, true
+	}
+	if req.ContentLength > maxReplay {
+		return nil, false
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(req.Body, maxReplay+1))
+	if err != nil || int64(len(buffered)) > maxReplay {
+		// Unknown length, and too long (or unreadable) - put back what was read and send the rest as it comes
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buffered), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(buffered))
+	return func() io.ReadCloser { return io.NopCloser(bytes.NewReader(buffered)) }, true
+}
+
+// backoff waits before a retry - a random time up to backoff_base, doubling each attempt up to backoff_max.
+// The randomness keeps retries from many clients from arriving in lockstep
+func backoff(ctx context.Context, retry config.RetryPolicy, attempt int) error {
+	ceiling := retry.BackoffMax
+	if attempt < 32 && retry.BackoffBase<<(attempt-1) < ceiling {
+		ceiling = retry.BackoffBase << (attempt - 1)
+	}
+	timer := time.NewTimer(rand.N(ceiling) + 1)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// targetURL is where the request to inbound goes on this target - what the target's director would make of it
+func (up *upstream) targetURL(inbound *url.URL) *url.URL {
+	rewritten := &http.Request{URL: new(url.URL), Header: http.Header{}}
+	*rewritten.URL = *inbound
+	up.director(rewritten)
+	return rewritten.URL
+}
+
+// forwardedBody counts the request as in flight to its target until the response has been read
+type forwardedBody struct {
+	io.ReadCloser
+	done     func()
+	doneOnce sync.Once
+}
+
+func (body *forwardedBody) Close() error {
+	body.doneOnce.Do(body.done)
+	return body.ReadCloser.Close()
+}
+
+// retryBudget caps retries at a share of recent requests, plus a small allowance - so when the backend is
+// struggling, retries can't pile several times the normal traffic on to it
+type retryBudget struct {
+	settings config.RetryBudgetConfig
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    [2]float64 // This window, and the one before
+	retries     [2]float64
+}
+
+func newRetryBudget(settings config.RetryBudgetConfig) *retryBudget {
+	return &retryBudget{settings: settings, windowStart: time.Now()}
+}
+
+// Request counts a request, retried or not
+func (budget *retryBudget) Request() {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.roll()
+	budget.requests[0]++
+}
+
+// Withdraw takes a retry from the budget - false if it's spent
+func (budget *retryBudget) Withdraw() bool {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.roll()
+	allowed := budget.settings.Ratio*(budget.requests[0]+budget.requests[1]) +
+		budget.settings.MinRetriesPerSecond*retryBudgetWindow.Seconds()
+	if budget.retries[0]+budget.retries[1] >= allowed {
+		return false
+	}
+	budget.retries[0]++
+	return true
+}
+
+func (budget *retryBudget) roll() {
+	elapsed := time.Since(budget.windowStart)
+	switch {
+	case elapsed < retryBudgetWindow:
+		return
+	case elapsed < 2*retryBudgetWindow:
+		budget.requests[1], budget.retries[1] = budget.requests[0], budget.retries[0]
+	default:
+		budget.requests[1], budget.retries[1] = 0, 0 // Nothing happened in the last window
+	}
+	budget.requests[0], budget.retries[0] = 0, 0
+	budget.windowStart = time.Now()
+}